@@ -23,3 +23,62 @@ func BenchmarkSet(b *testing.B) {
 		}
 	}
 }
+
+// The Fake benchmarks run against an in-process server so they work without a
+// memcached and mostly measure the client's own overhead. Run with -benchmem
+// (or see the allocs/op column) to check allocations per request.
+
+func BenchmarkFakeSet(b *testing.B) {
+	b.StopTimer()
+	fs := newFakeServer(b)
+	defer fs.close()
+	c := NewMC(fs.addr(), "", "")
+	// Lazy connection. Make sure it connects before starting benchmark.
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	defer b.StopTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := c.Set("foo", "bar", 0, 0, 0)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkFakeGet(b *testing.B) {
+	b.StopTimer()
+	fs := newFakeServer(b)
+	defer fs.close()
+	c := NewMC(fs.addr(), "", "")
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	defer b.StopTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _, _, err := c.Get("foo")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkHeaderEncodeDecode(b *testing.B) {
+	h := header{Magic: magicSend, Op: opSet, KeyLen: 3, ExtraLen: 8, BodyLen: 14, Opaque: 7, CAS: 42}
+	var buf [headerLen]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.encode(buf[:])
+		h.decode(buf[:])
+	}
+}
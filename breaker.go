@@ -0,0 +1,156 @@
+package mc
+
+// Per server circuit breaker.
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit Breaker:
+// A server that is slow or erroring, but not down enough to be ejected, makes
+// every request to it wait for a timeout. If Config.BreakerFailures is set,
+// each server gets a circuit breaker that opens after that many consecutive
+// requests failed with a network error (which includes timeouts). While open,
+// requests to the server fail right away: reads as a miss (ErrNotFound) and
+// writes with a network error. After BreakerOpenTime the breaker is half-open
+// and lets a single trial request through, closing again if it works and
+// reopening if it doesn't.
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails requests right away.
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial request through.
+	BreakerHalfOpen
+)
+
+func (st BreakerState) String() string {
+	switch st {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is the circuit breaker of a server. A nil breaker is always closed.
+type breaker struct {
+	threshold int
+	openTime  time.Duration
+	// changed is called after the breaker changed state
+	changed func(state BreakerState)
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a trial request is in flight while half-open
+}
+
+func newBreaker(config *Config, changed func(state BreakerState)) *breaker {
+	if config.BreakerFailures <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: config.BreakerFailures,
+		openTime:  config.BreakerOpenTime,
+		changed:   changed,
+	}
+}
+
+func errBreakerOpen(s *server) error {
+	return &Error{StatusNetworkError, "Circuit breaker open for server " + s.address, nil}
+}
+
+// allow says if a request may go through. A request allowed through must be
+// followed by a call to record with its result.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	switch b.state {
+	case BreakerClosed:
+		b.lock.Unlock()
+		return true
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTime {
+			b.lock.Unlock()
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		b.lock.Unlock()
+		b.changed(BreakerHalfOpen)
+		return true
+	}
+	// half-open, only one trial at a time
+	allow := !b.trial
+	b.trial = true
+	b.lock.Unlock()
+	return allow
+}
+
+// record records the result of a request allowed through.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil && connBroken(err)
+	b.lock.Lock()
+	old := b.state
+	switch {
+	case b.state == BreakerHalfOpen && b.trial:
+		b.trial = false
+		if failed {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		} else {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	case b.state == BreakerClosed && failed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		}
+	case b.state == BreakerClosed:
+		b.failures = 0
+	}
+	state := b.state
+	b.lock.Unlock()
+	if state != old {
+		b.changed(state)
+	}
+}
+
+// release releases a request allowed through without recording its result,
+// e.g., as it was cancelled.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+	}
+	b.lock.Unlock()
+}
+
+func (b *breaker) current() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
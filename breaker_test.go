@@ -0,0 +1,72 @@
+package mc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.BreakerFailures = 2
+	config.BreakerOpenTime = 50 * time.Millisecond
+	config.Failover = false // keep the only server in use
+	// fails twice, then works
+	c := newMockableMC("s1-3", "", "", config, newMockConn)
+	defer c.Quit()
+
+	var lock sync.Mutex
+	var states []BreakerState
+	c.OnBreakerStateChange(func(addr string, state BreakerState) {
+		lock.Lock()
+		defer lock.Unlock()
+		assertEqualf(t, "s1-3:11211", addr, "wrong address")
+		states = append(states, state)
+	})
+
+	for i := 0; i < 2; i++ {
+		_, _, _, err := c.Get("k1")
+		assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	}
+	assertEqualf(t, BreakerOpen, c.Servers()[0].Breaker, "breaker should be open")
+
+	// requests fail right away while open
+	_, _, _, err := c.Get("k1")
+	assertEqualf(t, ErrNotFound, err, "get should miss")
+	_, err = c.Set("k1", "val", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "set should fail: %v", err)
+
+	// trial request goes through once the breaker is half-open
+	time.Sleep(60 * time.Millisecond)
+	val, _, _, err := c.Get("k1")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "k1,s1,3", val, "trial request should reach the server")
+	assertEqualf(t, BreakerClosed, c.Servers()[0].Breaker, "breaker should be closed")
+
+	lock.Lock()
+	defer lock.Unlock()
+	assertEqualf(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}, states,
+		"wrong breaker state changes")
+}
+
+func TestBreakerTrialFails(t *testing.T) {
+	config := &Config{BreakerFailures: 1, BreakerOpenTime: 20 * time.Millisecond}
+	var states []BreakerState
+	b := newBreaker(config, func(state BreakerState) { states = append(states, state) })
+
+	assertTruef(t, b.allow(), "closed breaker should allow requests")
+	b.record(&Error{StatusNetworkError, "timeout", nil})
+	assertTruef(t, !b.allow(), "open breaker shouldn't allow requests")
+
+	time.Sleep(30 * time.Millisecond)
+	assertTruef(t, b.allow(), "half-open breaker should allow a trial")
+	assertTruef(t, !b.allow(), "half-open breaker should only allow one trial")
+	b.record(&Error{StatusNetworkError, "timeout", nil})
+	assertEqualf(t, BreakerOpen, b.current(), "failed trial should reopen the breaker")
+	assertTruef(t, !b.allow(), "reopened breaker shouldn't allow requests")
+	assertEqualf(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen}, states,
+		"wrong breaker state changes")
+
+	assertTruef(t, newBreaker(&Config{}, nil).allow(), "disabled breaker should allow requests")
+}
@@ -0,0 +1,205 @@
+package mc
+
+// Transparent chunking of values larger than the server item size limit.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// Large Values:
+// When Config.ChunkSize is set, values longer than it are stored as a number
+// of chunks under derived keys plus a small manifest under the original key:
+//
+//   manifest: chunkMagic | version (8) | chunks (4) | length (4) | crc32 (4)
+//   chunk i : "mc:chunk:<fnv64a(key)>:<version>:<i>"
+//
+// Every write uses a new random version, so a reader can never mix the chunks
+// of two different writes. The chunks are written first and the manifest last,
+// using the CAS given by the caller, so the manifest only ever points at a
+// complete set of chunks and concurrent writers are detected through CAS as
+// usual. The CAS returned to the caller is the CAS of the manifest.
+//
+// On Get the manifest is read first and the chunks are then fetched with a
+// pipelined multi-get. If a chunk was evicted or the reassembled value doesn't
+// match the manifest's length and checksum, the Get is reported as a miss
+// (ErrNotFound) rather than returning corrupt data.
+//
+// Append and Prepend fail with ErrInvalidArgs in this mode, as appending to a
+// manifest would corrupt it. A value that starts like a manifest but doesn't
+// decode (e.g., appended to by another client) is reported as a miss too.
+//
+// GAT and Touch update the expiration of the chunks along with the manifest's,
+// so a touched value doesn't lose its chunks before its manifest expires. Touch
+// then reads the manifest with a GAT, as it has to know the chunk keys.
+//
+// Chunks of overwritten or deleted values are not removed, they go away when
+// they expire or get evicted.
+
+const (
+	chunkMagic       = "\x00mc:chunked\x00"
+	chunkManifestLen = len(chunkMagic) + 8 + 4 + 4 + 4
+)
+
+// chunkManifest describes how a large value was split up.
+type chunkManifest struct {
+	version uint64
+	chunks  uint32
+	length  uint32
+	crc     uint32
+}
+
+func newChunkVersion() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (cm *chunkManifest) encode() string {
+	b := make([]byte, chunkManifestLen)
+	n := copy(b, chunkMagic)
+	binary.BigEndian.PutUint64(b[n:], cm.version)
+	binary.BigEndian.PutUint32(b[n+8:], cm.chunks)
+	binary.BigEndian.PutUint32(b[n+12:], cm.length)
+	binary.BigEndian.PutUint32(b[n+16:], cm.crc)
+	return string(b)
+}
+
+// decodeChunkManifest parses a manifest, returning false if val isn't one.
+func decodeChunkManifest(val string) (*chunkManifest, bool) {
+	if len(val) != chunkManifestLen || val[:len(chunkMagic)] != chunkMagic {
+		return nil, false
+	}
+	b := []byte(val[len(chunkMagic):])
+	return &chunkManifest{
+		version: binary.BigEndian.Uint64(b[0:8]),
+		chunks:  binary.BigEndian.Uint32(b[8:12]),
+		length:  binary.BigEndian.Uint32(b[12:16]),
+		crc:     binary.BigEndian.Uint32(b[16:20]),
+	}, true
+}
+
+// chunkKey derives the key of the i-th chunk of a value. The original key is
+// hashed so chunk keys stay short whatever the length of the key.
+func chunkKey(key string, version uint64, i int) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("mc:chunk:%016x:%016x:%d", h.Sum64(), version, i)
+}
+
+// setChunked stores a large value as chunks plus a manifest. op is the
+// operation (Set, Add or Replace) used for the manifest.
+func (c *Client) setChunked(ctx context.Context, op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
+	size := c.config.ChunkSize
+	cm := &chunkManifest{
+		version: newChunkVersion(),
+		chunks:  uint32((len(val) + size - 1) / size),
+		length:  uint32(len(val)),
+		crc:     crc32.ChecksumIEEE([]byte(val)),
+	}
+
+	for i := 0; i < int(cm.chunks); i++ {
+		end := (i + 1) * size
+		if end > len(val) {
+			end = len(val)
+		}
+		m := &msg{
+			header: header{
+				Op: opSet,
+			},
+			iextras: setExtras{0, exp},
+			key:     chunkKey(key, cm.version, i),
+			val:     val[i*size : end],
+			chunkOf: key,
+			ctx:     ctx,
+		}
+		err = c.perform(m)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	m := &msg{
+		header: header{
+			Op:  op,
+			CAS: ocas,
+		},
+		iextras: setExtras{flags, exp},
+		key:     key,
+		val:     cm.encode(),
+		ctx:     ctx,
+	}
+	err = c.perform(m)
+	return m.CAS, err
+}
+
+// unchunk returns val unchanged unless it is a manifest, in which case the
+// chunks are fetched and the original value is reassembled.
+func (c *Client) unchunk(ctx context.Context, key, val string) (string, error) {
+	cm, ok := decodeChunkManifest(val)
+	if !ok {
+		if strings.HasPrefix(val, chunkMagic) {
+			// a manifest that was appended or prepended to
+			return "", ErrNotFound
+		}
+		return val, nil
+	}
+
+	keys := make([]string, cm.chunks)
+	for i := range keys {
+		keys[i] = chunkKey(key, cm.version, i)
+	}
+	chunks, err := c.getMulti(ctx, keys)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 0, cm.length)
+	for _, k := range keys {
+		m, ok := chunks[k]
+		if !ok || len(b)+len(m.val) > int(cm.length) {
+			return "", ErrNotFound
+		}
+		b = append(b, m.val...)
+	}
+	if len(b) != int(cm.length) || crc32.ChecksumIEEE(b) != cm.crc {
+		return "", ErrNotFound
+	}
+	return string(b), nil
+}
+
+// touchChunks updates the expiration time of the chunks of val if it is a
+// manifest. A chunk that is gone makes the value a miss (ErrNotFound).
+func (c *Client) touchChunks(ctx context.Context, key, val string, exp uint32) error {
+	cm, ok := decodeChunkManifest(val)
+	if !ok {
+		if strings.HasPrefix(val, chunkMagic) {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	for i := 0; i < int(cm.chunks); i++ {
+		m := &msg{
+			header: header{
+				Op: opTouch,
+			},
+			iextras: touchExtras{exp},
+			key:     chunkKey(key, cm.version, i),
+			chunkOf: key,
+			ctx:     ctx,
+		}
+		if err := c.perform(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkedSetGet(t *testing.T) {
+	config := DefaultConfig()
+	config.ChunkSize = 10
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	const Key = "large"
+	val := strings.Repeat("0123456789abcdef", 5)
+
+	cas, err := c.Set(Key, val, 7, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 9, len(fs.keys()), "expected 8 chunks and a manifest: %v", fs.keys())
+
+	v, flags, cas2, err := c.Get(Key)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value: %s", v)
+	assertEqualf(t, uint32(7), flags, "wrong flags: %d", flags)
+	assertEqualf(t, cas, cas2, "CAS should be the manifest's: %d, %d", cas, cas2)
+	assertEqualf(t, 1, fs.requests(opNoop), "chunks should be fetched in one batch")
+
+	// CAS protects the manifest as it would a plain value
+	_, err = c.Set(Key, val+"x", 0, 0, cas+1)
+	assertEqualf(t, ErrKeyExists, err, "expected CAS mismatch: %v", err)
+	_, err = c.Set(Key, val+"x", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = c.Get(Key)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val+"x", v, "wrong value: %s", v)
+
+	// small values are stored as is
+	_, err = c.Set("small", "tiny", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err = c.Get("small")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "tiny", v, "wrong value: %s", v)
+}
+
+func TestChunkedMissingChunk(t *testing.T) {
+	config := DefaultConfig()
+	config.ChunkSize = 4
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	const Key = "large"
+	_, err := c.Set(Key, "abcdefghijkl", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	for _, k := range fs.keys() {
+		if strings.HasSuffix(k, ":1") {
+			fs.del(k)
+		}
+	}
+	_, _, cas, err := c.Get(Key)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+	assertEqualf(t, uint64(0), cas, "CAS should be zero on a miss: %d", cas)
+}
+
+func TestChunkedCorruptChunk(t *testing.T) {
+	config := DefaultConfig()
+	config.ChunkSize = 4
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	const Key = "large"
+	_, err := c.Set(Key, "abcdefghijkl", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	for _, k := range fs.keys() {
+		if strings.HasSuffix(k, ":2") {
+			fs.corrupt(k)
+		}
+	}
+	_, _, _, err = c.Get(Key)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+}
+
+func TestChunkedAppend(t *testing.T) {
+	config := DefaultConfig()
+	config.ChunkSize = 4
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	const Key = "large"
+	_, err := c.Set(Key, "abcdefghijkl", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Append(Key, "XYZ", 0)
+	assertEqualf(t, ErrInvalidArgs, err, "expected append to be refused: %v", err)
+	_, err = c.Prepend(Key, "XYZ", 0)
+	assertEqualf(t, ErrInvalidArgs, err, "expected prepend to be refused: %v", err)
+	assertEqualf(t, 0, fs.requests(opAppend)+fs.requests(opPrepend), "nothing should be sent")
+
+	// a manifest appended to by a client without chunking is a miss
+	plain := NewMCwithConfig(fs.addr(), "", "", DefaultConfig())
+	defer plain.Quit()
+	_, err = plain.Append(Key, "XYZ", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get(Key)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+	_, _, _, err = c.GAT(Key, 10)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+	_, err = c.Touch(Key, 10)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+}
+
+func TestChunkedMultiServer(t *testing.T) {
+	fs1 := newFakeServer(t)
+	defer fs1.close()
+	fs2 := newFakeServer(t)
+	defer fs2.close()
+
+	config := DefaultConfig()
+	config.ChunkSize = 3
+	c := NewMCwithConfig(fs1.addr()+","+fs2.addr(), "", "", config)
+
+	val := strings.Repeat("xyz", 40) + "!"
+	_, err := c.Set("large", val, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, len(fs1.keys()) > 0 && len(fs2.keys()) > 0,
+		"chunks should be spread over both servers")
+
+	v, _, _, err := c.Get("large")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value: %s", v)
+}
+
+// GAT and Touch extend the life of the chunks along with the manifest's.
+func TestChunkedTouch(t *testing.T) {
+	config := DefaultConfig()
+	config.ChunkSize = 4
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	_, err := c.Set("gat", "abcdefghijkl", 0, 1, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set("touch", "mnopqrstuvwx", 0, 1, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, _, _, err := c.GAT("gat", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "abcdefghijkl", v, "wrong value: %s", v)
+	assertEqualf(t, 3, fs.requests(opTouch), "expected a touch per chunk")
+	_, err = c.Touch("touch", 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 6, fs.requests(opTouch), "expected a touch per chunk")
+
+	time.Sleep(1100 * time.Millisecond)
+	v, _, _, err = c.Get("gat")
+	assertEqualf(t, mcNil, err, "chunks expired: %v", err)
+	assertEqualf(t, "abcdefghijkl", v, "wrong value: %s", v)
+	v, _, _, err = c.Get("touch")
+	assertEqualf(t, mcNil, err, "chunks expired: %v", err)
+	assertEqualf(t, "mnopqrstuvwx", v, "wrong value: %s", v)
+
+	// a chunk gone makes GAT a miss
+	for _, k := range fs.keys() {
+		if strings.HasSuffix(k, ":1") {
+			fs.del(k)
+		}
+	}
+	_, _, _, err = c.GAT("gat", 0)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+}
@@ -3,8 +3,11 @@
 package mc
 
 import (
-	"fmt"
+	"context"
+	"encoding/binary"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -57,9 +60,30 @@ import (
 //   seconds will actually expire somewhere in the range of (3,4) seconds.
 
 // Client represents a memcached client that is connected to a list of servers
+//
+// The Context variants of operations (GetContext, SetContext, ...) run within
+// ctx: once ctx is done, they give up waiting for a connection, between retries
+// or in the middle of a request, failing with an Error that wraps ctx.Err().
+// The deadline of ctx caps that of the operation (see Config.OperationTimeout).
+// They are also traced as part of the operation in ctx, see Config.Tracer.
 type Client struct {
-	servers []*server
-	config  *Config
+	servers   []*server
+	config    *Config
+	ejectLock sync.Mutex
+
+	stateLock        sync.Mutex
+	stateListeners   []func(addr string, alive bool, cause error)
+	breakerListeners []func(addr string, state BreakerState)
+
+	// pools and route are only set on a routing client, see NewRoutedMC
+	pools []*keyPool
+	route func(key string) string
+	// migration is only set on a migrating client, see NewMigratingMC
+	migration *migration
+	// shadow is only set on a shadowed client, see NewShadowedMC
+	shadow *shadow
+	// metrics is nil unless Config.Metrics is set
+	metrics *clientMetrics
 }
 
 // NewMC creates a new client with the default configuration. For the default
@@ -76,15 +100,17 @@ func NewMCwithConfig(servers, username, password string, config *Config) *Client
 // newMockableMC creates a new client for testing that allows to mock the server
 // connection
 func newMockableMC(servers, username, password string, config *Config, newMcConn connGen) *Client {
-	client := &Client{config: config}
+	client := &Client{config: config, metrics: newClientMetrics(config)}
 
 	s := func(r rune) bool {
 		return r == ',' || r == ';' || r == ' '
 	}
 	serverList := strings.FieldsFunc(servers, s)
 	for _, addr := range serverList {
-		client.servers = append(client.servers,
-			newServer(addr, username, password, config, newMcConn))
+		server := newServer(addr, username, password, config, newMcConn)
+		server.stateChanged = client.notifyStateChange
+		server.breakerChanged = client.notifyBreakerChange
+		client.servers = append(client.servers, server)
 	}
 
 	client.config.Hasher.update(client.servers)
@@ -93,51 +119,168 @@ func newMockableMC(servers, username, password string, config *Config, newMcConn
 }
 
 func (c *Client) perform(m *msg) error {
+	if c.migration != nil {
+		return c.migration.perform(m)
+	}
+	if c.shadow != nil {
+		return c.shadow.perform(m)
+	}
+	if c.config.Replicas > 1 {
+		return c.performReplicated(m)
+	}
 	// failover on error
 	for {
-		s, err := c.getServer(m.key)
+		s, err := c.getServer(m.key, isWrite(m.Op))
 		if err != nil {
 			return err
 		}
-		err = s.perform(m)
-		if err != nil && err.(*Error).Status == StatusNetworkError && c.config.Failover {
-			// Failover on network errors
-			if s.changeAlive(false) {
-				go c.wakeUp(s)
-			}
-			continue
+		ejected, err := c.performOn(s, m)
+		if !ejected || (isWrite(m.Op) && !c.config.FailoverWrites) {
+			return err
 		}
-		return err
 	}
-	return nil
 }
 
-func (c *Client) wakeUp(s *server) {
-	time.Sleep(c.config.DownRetryDelay)
-	s.changeAlive(true)
+// performOn performs m on server s, going through its circuit breaker and
+// ejecting it if the ejection policy says so. It reports whether s was ejected.
+func (c *Client) performOn(s *server, m *msg) (ejected bool, err error) {
+	if !s.breaker.allow() {
+		if isWrite(m.Op) {
+			return false, errBreakerOpen(s)
+		}
+		return false, ErrNotFound
+	}
+	if c.hedgeable(m) {
+		err = s.performHedged(m, c.hedgeTarget(s, m))
+	} else {
+		err = s.perform(m)
+	}
+	if err != nil && m.ctxErr() != nil {
+		// given up, which says nothing about s
+		s.breaker.release()
+		return false, err
+	}
+	s.breaker.record(err)
+	if !c.config.Failover {
+		// a server is only ejected for its keys to fail over
+		return false, err
+	}
+	if err == nil || err.(*Error).Status != StatusNetworkError {
+		s.ejection.Success()
+		return false, err
+	}
+	// eject the server if the policy says so, as long as that doesn't
+	// leave too few servers
+	if !s.ejection.Failure() || !c.eject(s, err) {
+		return false, err
+	}
+	go s.revive()
+	return true, err
 }
 
-func (c *Client) getServer(key string) (*server, error) {
+// startOp starts the operation op on key: it sets the deadline of the
+// operation in ctx, if there is an OperationTimeout and ctx isn't already that
+// of an operation, and starts the span of the operation.
+func (c *Client) startOp(ctx context.Context, op opCode, key string) (context.Context, Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.config.OperationTimeout > 0 && ctx.Value(opDeadlineKey{}) == nil {
+		ctx = context.WithValue(ctx, opDeadlineKey{}, time.Now().Add(c.config.OperationTimeout))
+	}
+	return c.startSpan(ctx, op, key)
+}
+
+// getServer returns the server handling key, which is the key's own server
+// unless that one is dead (see Config.FailoverStrategy). write says if the key
+// is going to be modified.
+func (c *Client) getServer(key string, write bool) (*server, error) {
 	idx, err := c.config.Hasher.getServerIndex(key)
 	if err != nil {
 		return nil, err
 	}
-	nServers := uint(len(c.servers))
-	for i := uint(0); i < nServers; i++ {
-		s := c.servers[(idx+i)%nServers]
-		if s.isAlive {
-			return s, nil
+	s := c.servers[idx]
+	if s.alive() {
+		return s, nil
+	}
+	fs, err := c.failoverServer(key, idx, write)
+	if err == nil {
+		s.metrics.failover()
+		c.config.log(LogDebug, "mc: failing over", "server", s.address, "to", fs.address)
+	}
+	return fs, err
+}
+
+// getMulti retrieves several keys at once, pipelining the requests to each
+// server so a batch costs a single round trip per server. Keys that weren't
+// found are missing from the returned map.
+func (c *Client) getMulti(ctx context.Context, keys []string) (map[string]*msg, error) {
+	if c.migration != nil {
+		return c.migration.getMulti(ctx, keys)
+	}
+	if c.shadow != nil {
+		return c.shadow.primary.getMulti(ctx, keys)
+	}
+	batches := make(map[*server][]*msg)
+	for _, key := range keys {
+		s, err := c.getServer(key, false)
+		if err == ErrNotFound {
+			// key on a dead server, see FailoverFailFast
+			continue
+		} else if err != nil {
+			return nil, err
 		}
+		batches[s] = append(batches[s], &msg{key: key, ctx: ctx})
 	}
-	return nil, &Error{StatusNetworkError, "All server currently dead", nil}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(batches))
+	for s, ms := range batches {
+		wg.Add(1)
+		go func(s *server, ms []*msg) {
+			defer wg.Done()
+			if !s.breaker.allow() {
+				// breaker open, all of the server's keys are misses
+				for _, m := range ms {
+					m.ResvOrStatus = StatusNotFound
+				}
+				return
+			}
+			err := s.performMulti(ms)
+			s.breaker.record(err)
+			errs <- err
+		}(s, ms)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vals := make(map[string]*msg, len(keys))
+	for _, ms := range batches {
+		for _, m := range ms {
+			if m.ResvOrStatus == StatusOK {
+				vals[m.key] = m
+			}
+		}
+	}
+	return vals, nil
 }
 
 // Get retrieves a value from the cache.
 func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, within ctx (see Client).
+func (c *Client) GetContext(ctx context.Context, key string) (val string, flags uint32, cas uint64, err error) {
 	// Variants: [R] Get [Q, K, KQ]
 	// Request : MUST key; MUST NOT value, extras
 	// Response: MAY key, value, extras ([0..3] flags)
-	return c.getCAS(key, 0)
+	return c.getCAS(ctx, key, 0)
 }
 
 // getCAS retrieves a value in the cache but only if the CAS specified matches
@@ -146,26 +289,51 @@ func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err erro
 // NOTE: GET doesn't actually care about CAS, but we want this internally for
 // testing purposes, to be able to test that a memcache server obeys the proper
 // semantics of ignoring CAS with GETs.
-func (c *Client) getCAS(key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
+func (c *Client) getCAS(ctx context.Context, key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opGet, key)
+	defer func() { endSpan(span, opGet, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opGet, key, 0, nil, time.Now(), &err)
+	}
+
 	m := &msg{
 		header: header{
 			Op:  opGet,
 			CAS: uint64(ocas),
 		},
-		oextras: []interface{}{&flags},
-		key:     key,
+		key: key,
+		ctx: ctx,
 	}
 
 	err = c.perform(m)
+	if c.config.ChunkSize > 0 && err == nil {
+		m.val, err = c.unchunk(ctx, key, m.val)
+		if err != nil {
+			return "", 0, 0, err
+		}
+	}
 	if c.config.Compression.Decompress != nil && err == nil {
 		m.val, err = c.config.Compression.Decompress(m.val)
 	}
-	return m.val, flags, m.CAS, err
+	return m.val, m.flags, m.CAS, err
 }
 
 // GAT (get and touch) retrieves the value associated with the key and updates
 // its expiration time.
 func (c *Client) GAT(key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
+	return c.GATContext(context.Background(), key, exp)
+}
+
+// GATContext is GAT, within ctx (see Client).
+func (c *Client) GATContext(ctx context.Context, key string, exp uint32) (val string, flags uint32, cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opGAT, key)
+	defer func() { endSpan(span, opGAT, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opGAT, key, 0, touchExtras{exp}, time.Now(), &err)
+	}
+
 	// Variants: GAT [Q, K, KQ]
 	// Request : MUST key, extras; MUST NOT value
 	// Response: MAY key, value, extras ([0..3] flags)
@@ -173,17 +341,38 @@ func (c *Client) GAT(key string, exp uint32) (val string, flags uint32, cas uint
 		header: header{
 			Op: opGAT,
 		},
-		iextras: []interface{}{exp},
-		oextras: []interface{}{&flags},
+		iextras: touchExtras{exp},
 		key:     key,
+		ctx:     ctx,
 	}
 
 	err = c.perform(m)
-	return m.val, flags, m.CAS, err
+	if c.config.ChunkSize > 0 && err == nil {
+		err = c.touchChunks(ctx, key, m.val, exp)
+		if err == nil {
+			m.val, err = c.unchunk(ctx, key, m.val)
+		}
+		if err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return m.val, m.flags, m.CAS, err
 }
 
 // Touch updates the expiration time on a key/value pair in the cache.
 func (c *Client) Touch(key string, exp uint32) (cas uint64, err error) {
+	return c.TouchContext(context.Background(), key, exp)
+}
+
+// TouchContext is Touch, within ctx (see Client).
+func (c *Client) TouchContext(ctx context.Context, key string, exp uint32) (cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opTouch, key)
+	defer func() { endSpan(span, opTouch, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opTouch, key, 0, touchExtras{exp}, time.Now(), &err)
+	}
+
 	// Variants: Touch
 	// Request : MUST key, extras; MUST NOT value
 	// Response: MUST NOT key, value, extras
@@ -191,36 +380,69 @@ func (c *Client) Touch(key string, exp uint32) (cas uint64, err error) {
 		header: header{
 			Op: opTouch,
 		},
-		iextras: []interface{}{exp},
+		iextras: touchExtras{exp},
 		key:     key,
+		ctx:     ctx,
+	}
+	if c.config.ChunkSize > 0 {
+		// the value is needed to tell whether it has chunks to touch
+		m.Op = opGAT
 	}
 
 	err = c.perform(m)
+	if c.config.ChunkSize > 0 && err == nil {
+		err = c.touchChunks(ctx, key, m.val, exp)
+		if err != nil {
+			return 0, err
+		}
+	}
 	return m.CAS, err
 }
 
 // Set sets a key/value pair in the cache.
 func (c *Client) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	return c.SetContext(context.Background(), key, val, flags, exp, ocas)
+}
+
+// SetContext is Set, within ctx (see Client).
+func (c *Client) SetContext(ctx context.Context, key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
 	// Variants: [R] Set [Q]
-	return c.setGeneric(opSet, key, val, ocas, flags, exp)
+	return c.setGeneric(ctx, opSet, key, val, ocas, flags, exp)
 }
 
 // Replace replaces an existing key/value in the cache. Fails if key doesn't
 // already exist in cache.
 func (c *Client) Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	return c.ReplaceContext(context.Background(), key, val, flags, exp, ocas)
+}
+
+// ReplaceContext is Replace, within ctx (see Client).
+func (c *Client) ReplaceContext(ctx context.Context, key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
 	// Variants: Replace [Q]
-	return c.setGeneric(opReplace, key, val, ocas, flags, exp)
+	return c.setGeneric(ctx, opReplace, key, val, ocas, flags, exp)
 }
 
 // Add adds a new key/value to the cache. Fails if the key already exists in the
 // cache.
 func (c *Client) Add(key, val string, flags, exp uint32) (cas uint64, err error) {
+	return c.AddContext(context.Background(), key, val, flags, exp)
+}
+
+// AddContext is Add, within ctx (see Client).
+func (c *Client) AddContext(ctx context.Context, key, val string, flags, exp uint32) (cas uint64, err error) {
 	// Variants: Add [Q]
-	return c.setGeneric(opAdd, key, val, 0, flags, exp)
+	return c.setGeneric(ctx, opAdd, key, val, 0, flags, exp)
 }
 
 // Set/Add/Replace a key/value pair in the cache.
-func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
+func (c *Client) setGeneric(ctx context.Context, op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, op, key)
+	defer func() { endSpan(span, op, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(op, key, len(val), setExtras{flags, exp}, time.Now(), &err)
+	}
+
 	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
 	// Response: MUST NOT key, value, extras
 	// CAS: If a CAS is specified (non-zero), all sets only succeed if the key
@@ -230,15 +452,20 @@ func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp
 			Op:  op,
 			CAS: ocas,
 		},
-		iextras: []interface{}{flags, exp},
+		iextras: setExtras{flags, exp},
 		key:     key,
 		val:     val,
+		ctx:     ctx,
 	}
 	if c.config.Compression.Compress != nil {
 		m.val, err = c.config.Compression.Compress(m.val)
 		if err != nil {
 			return m.CAS, err
 		}
+		c.metrics.compressed(len(val), len(m.val))
+	}
+	if c.config.ChunkSize > 0 && len(m.val) > c.config.ChunkSize {
+		return c.setChunked(ctx, op, key, m.val, ocas, flags, exp)
 	}
 	err = c.perform(m)
 	return m.CAS, err
@@ -248,17 +475,34 @@ func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp
 // integer stored as an ASCII string. It will wrap when incremented outside the
 // range.
 func (c *Client) Incr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
-	return c.incrdecr(opIncrement, key, delta, init, exp, ocas)
+	return c.IncrContext(context.Background(), key, delta, init, exp, ocas)
+}
+
+// IncrContext is Incr, within ctx (see Client).
+func (c *Client) IncrContext(ctx context.Context, key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	return c.incrdecr(ctx, opIncrement, key, delta, init, exp, ocas)
 }
 
 // Decr decrements a value in the cache. The value must be an unsigned 64bit
 // integer stored as an ASCII string. It can't be decremented below 0.
 func (c *Client) Decr(key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
-	return c.incrdecr(opDecrement, key, delta, init, exp, ocas)
+	return c.DecrContext(context.Background(), key, delta, init, exp, ocas)
+}
+
+// DecrContext is Decr, within ctx (see Client).
+func (c *Client) DecrContext(ctx context.Context, key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	return c.incrdecr(ctx, opDecrement, key, delta, init, exp, ocas)
 }
 
 // Incr/Decr a key/value pair in the cache.
-func (c *Client) incrdecr(op opCode, key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+func (c *Client) incrdecr(ctx context.Context, op opCode, key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, op, key)
+	defer func() { endSpan(span, op, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(op, key, 0, incrExtras{delta, init, exp}, time.Now(), &err)
+	}
+
 	// Variants: [R] Incr [Q], [R] Decr [Q]
 	// Request : MUST key, extras; MUST NOT value
 	//   Extras: [ 0.. 7] Amount to add/sub
@@ -274,32 +518,63 @@ func (c *Client) incrdecr(op opCode, key string, delta, init uint64, exp uint32,
 			Op:  op,
 			CAS: ocas,
 		},
-		iextras: []interface{}{delta, init, exp},
+		iextras: incrExtras{delta, init, exp},
 		key:     key,
+		ctx:     ctx,
 	}
 
 	err = c.perform(m)
 	if err != nil {
 		return
 	}
-	// value is returned as an unsigned 64bit integer (i.e., not as a string)
-	return readInt(m.val), m.CAS, nil
+	n, err = readInt(m.val)
+	return n, m.CAS, err
 }
 
-// Convert string stored to an uint64 (where no actual byte changes are needed).
-func readInt(b string) uint64 {
-	switch len(b) {
-	case 8: // 64 bit
-		return uint64(uint64(b[7]) | uint64(b[6])<<8 | uint64(b[5])<<16 | uint64(b[4])<<24 |
-			uint64(b[3])<<32 | uint64(b[2])<<40 | uint64(b[1])<<48 | uint64(b[0])<<56)
+// readInt parses the counter returned by incr/decr. memcached returns it as an
+// unsigned 64bit integer (i.e., not as a string), but some proxies and
+// text/meta protocol backends return the decimal ASCII string instead. An 8
+// byte value is binary unless it is made only of digits, as a binary counter
+// would have to be at least 0x3030303030303030 (about 3.47e18) to look like
+// that. Values of any other length are ASCII, surrounding whitespace (e.g., a
+// trailing "\r\n") being ignored.
+func readInt(b string) (uint64, error) {
+	if len(b) == 8 && !isDigits(b) {
+		return binary.BigEndian.Uint64([]byte(b)), nil
+	}
+	s := strings.TrimSpace(b)
+	if len(s) > 0 && len(s) <= 20 && isDigits(s) {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err == nil {
+			return n, nil
+		}
 	}
+	return 0, protocolError("can't parse counter of %d bytes", len(b))
+}
 
-	panic(fmt.Sprintf("mc: don't know how to parse string with %d bytes", len(b)))
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
 }
 
 // Append appends the value to the existing value for the key specified. An
 // error is thrown if the key doesn't exist.
 func (c *Client) Append(key, val string, ocas uint64) (cas uint64, err error) {
+	return c.AppendContext(context.Background(), key, val, ocas)
+}
+
+// AppendContext is Append, within ctx (see Client).
+func (c *Client) AppendContext(ctx context.Context, key, val string, ocas uint64) (cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opAppend, key)
+	defer func() { endSpan(span, opAppend, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opAppend, key, len(val), nil, time.Now(), &err)
+	}
+	if c.config.ChunkSize > 0 {
+		// appending to a manifest would corrupt it, see Config.ChunkSize
+		return 0, ErrInvalidArgs
+	}
+
 	// Variants: [R] Append [Q]
 	// Request : MUST key, value; MUST NOT extras
 	// Response: MUST NOT key, value, extras
@@ -310,6 +585,7 @@ func (c *Client) Append(key, val string, ocas uint64) (cas uint64, err error) {
 		},
 		key: key,
 		val: val,
+		ctx: ctx,
 	}
 
 	err = c.perform(m)
@@ -319,6 +595,22 @@ func (c *Client) Append(key, val string, ocas uint64) (cas uint64, err error) {
 // Prepend prepends the value to the existing value for the key specified. An
 // error is thrown if the key doesn't exist.
 func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
+	return c.PrependContext(context.Background(), key, val, ocas)
+}
+
+// PrependContext is Prepend, within ctx (see Client).
+func (c *Client) PrependContext(ctx context.Context, key, val string, ocas uint64) (cas uint64, err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opPrepend, key)
+	defer func() { endSpan(span, opPrepend, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opPrepend, key, len(val), nil, time.Now(), &err)
+	}
+	if c.config.ChunkSize > 0 {
+		// appending to a manifest would corrupt it, see Config.ChunkSize
+		return 0, ErrInvalidArgs
+	}
+
 	// Variants: [R] Append [Q]
 	// Request : MUST key, value; MUST NOT extras
 	// Response: MUST NOT key, value, extras
@@ -329,6 +621,7 @@ func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
 		},
 		key: key,
 		val: val,
+		ctx: ctx,
 	}
 
 	err = c.perform(m)
@@ -337,12 +630,29 @@ func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
 
 // Del deletes a key/value from the cache.
 func (c *Client) Del(key string) (err error) {
-	return c.DelCAS(key, 0)
+	return c.DelCASContext(context.Background(), key, 0)
+}
+
+// DelContext is Del, within ctx (see Client).
+func (c *Client) DelContext(ctx context.Context, key string) (err error) {
+	return c.DelCASContext(ctx, key, 0)
 }
 
 // DelCAS deletes a key/value from the cache but only if the CAS specified
 // matches the CAS in the cache.
 func (c *Client) DelCAS(key string, cas uint64) (err error) {
+	return c.DelCASContext(context.Background(), key, cas)
+}
+
+// DelCASContext is DelCAS, within ctx (see Client).
+func (c *Client) DelCASContext(ctx context.Context, key string, cas uint64) (err error) {
+	c = c.pick(key)
+	ctx, span := c.startOp(ctx, opDelete, key)
+	defer func() { endSpan(span, opDelete, err) }()
+	if tr := c.config.TrafficRecorder; tr != nil {
+		defer tr.observe(opDelete, key, 0, nil, time.Now(), &err)
+	}
+
 	// Variants: [R] Del [Q]
 	// Request : MUST key; MUST NOT value, extras
 	// Response: MUST NOT key, value, extras
@@ -352,6 +662,7 @@ func (c *Client) DelCAS(key string, cas uint64) (err error) {
 			CAS: cas,
 		},
 		key: key,
+		ctx: ctx,
 	}
 
 	return c.perform(m)
@@ -362,6 +673,14 @@ func (c *Client) DelCAS(key string, cas uint64) (err error) {
 // nature of memcache). Instead nearly all servers do lazy expiration, where
 // they don't free memory but won't return any keys to you that have expired.
 func (c *Client) Flush(when uint32) (err error) {
+	return c.FlushContext(context.Background(), when)
+}
+
+// FlushContext is Flush, within ctx (see Client).
+func (c *Client) FlushContext(ctx context.Context, when uint32) (err error) {
+	ctx, span := c.startOp(ctx, opFlush, "")
+	defer func() { endSpan(span, opFlush, err) }()
+
 	// Variants: Flush [Q]
 	// Request : MUST NOT key, value; MAY extras ([0..3] expiration)
 	// Response: MUST NOT key, value, extras
@@ -373,11 +692,12 @@ func (c *Client) Flush(when uint32) (err error) {
 		header: header{
 			Op: opFlush,
 		},
-		iextras: []interface{}{when},
+		iextras: flushExtras{when},
+		ctx:     ctx,
 	}
 
 	for _, s := range c.servers {
-		if s.isAlive {
+		if s.alive() {
 			var ms msg = *m
 			err = s.perform(&ms)
 		}
@@ -388,6 +708,14 @@ func (c *Client) Flush(when uint32) (err error) {
 // NoOp sends a No-Op message to the memcache server. This can be used as a
 // heartbeat for the server to check it's functioning fine still.
 func (c *Client) NoOp() (err error) {
+	return c.NoOpContext(context.Background())
+}
+
+// NoOpContext is NoOp, within ctx (see Client).
+func (c *Client) NoOpContext(ctx context.Context) (err error) {
+	ctx, span := c.startOp(ctx, opNoop, "")
+	defer func() { endSpan(span, opNoop, err) }()
+
 	// Variants: NoOp
 	// Request : MUST NOT key, value, extras
 	// Response: MUST NOT key, value, extras
@@ -395,10 +723,11 @@ func (c *Client) NoOp() (err error) {
 		header: header{
 			Op: opNoop,
 		},
+		ctx: ctx,
 	}
 
 	for _, s := range c.servers {
-		if s.isAlive {
+		if s.alive() {
 			var ms msg = *m
 			err = s.perform(&ms)
 		}
@@ -408,6 +737,14 @@ func (c *Client) NoOp() (err error) {
 
 // Version gets the version of the memcached server connected to.
 func (c *Client) Version() (vers map[string]string, err error) {
+	return c.VersionContext(context.Background())
+}
+
+// VersionContext is Version, within ctx (see Client).
+func (c *Client) VersionContext(ctx context.Context) (vers map[string]string, err error) {
+	ctx, span := c.startOp(ctx, opVersion, "")
+	defer func() { endSpan(span, opVersion, err) }()
+
 	// Variants: Version
 	// Request : MUST NOT key, value, extras
 	// Response: MUST NOT key, extras; MUST value
@@ -417,11 +754,12 @@ func (c *Client) Version() (vers map[string]string, err error) {
 		header: header{
 			Op: opVersion,
 		},
+		ctx: ctx,
 	}
 
 	vers = make(map[string]string)
 	for _, s := range c.servers {
-		if s.isAlive {
+		if s.alive() {
 			var ms msg = *m
 			err = s.perform(&ms)
 			if err == nil {
@@ -450,10 +788,63 @@ func (c *Client) Quit() {
 	}
 }
 
+// Warmup opens all connections to every server up front rather than lazily on
+// first use, so the first requests don't pay for dialing and authentication,
+// and problems such as a wrong password are found straight away. It returns
+// the outcome for each server keyed by address, nil meaning all of the
+// server's connections are ready. If ctx is done before a server is warmed
+// up, the context's error is reported for it.
+func (c *Client) Warmup(ctx context.Context) map[string]error {
+	type result struct {
+		addr string
+		err  error
+	}
+	results := make(chan result, len(c.servers))
+	for _, s := range c.servers {
+		go func(s *server) {
+			results <- result{s.address, s.pool.warmup(ctx)}
+		}(s)
+	}
+
+	report := make(map[string]error, len(c.servers))
+	for range c.servers {
+		select {
+		case r := <-results:
+			report[r.addr] = r.err
+		case <-ctx.Done():
+			for _, s := range c.servers {
+				if _, ok := report[s.address]; !ok {
+					report[s.address] = wrapError(StatusNetworkError, ctx.Err())
+				}
+			}
+			return report
+		}
+	}
+	return report
+}
+
+// PoolStats returns the state and usage statistics of the connection pool of
+// each server, keyed by server address.
+func (c *Client) PoolStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats)
+	for _, s := range c.servers {
+		stats[s.address] = s.pool.poolStats()
+	}
+	return stats
+}
+
 // StatsWithKey returns some statistics about the memcached server. It supports
 // sending across a key to the server to select which statistics should be
 // returned.
 func (c *Client) StatsWithKey(key string) (map[string]McStats, error) {
+	return c.StatsWithKeyContext(context.Background(), key)
+}
+
+// StatsWithKeyContext is StatsWithKey, within ctx (see Client).
+func (c *Client) StatsWithKeyContext(ctx context.Context, key string) (allStats map[string]McStats, err error) {
+	ctx, span := c.startOp(ctx, opStat, "")
+	defer func() { endSpan(span, opStat, err) }()
+
 	// Variants: Stats
 	// Request : MAY HAVE key, MUST NOT value, extra
 	// Response: Serries of responses that MUST HAVE key, value; followed by one
@@ -463,11 +854,12 @@ func (c *Client) StatsWithKey(key string) (map[string]McStats, error) {
 			Op: opStat,
 		},
 		key: key,
+		ctx: ctx,
 	}
 
-	allStats := make(map[string]McStats)
+	allStats = make(map[string]McStats)
 	for _, s := range c.servers {
-		if s.isAlive {
+		if s.alive() {
 			stats, err := s.performStats(m)
 			if err != nil {
 				return nil, err
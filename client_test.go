@@ -1,6 +1,7 @@
 package mc
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"regexp"
@@ -72,24 +73,24 @@ func TestGet(t *testing.T) {
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 
 	// retrieve value with 0 CAS...
-	v1, _, cas1, err := c.getCAS(Key1, 0)
+	v1, _, cas1, err := c.getCAS(context.Background(), Key1, 0)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, Val1, v1, "wrong value: %s", v1)
 
 	// retrieve value with good CAS...
-	v2, _, cas2, err := c.getCAS(Key1, cas1)
+	v2, _, cas2, err := c.getCAS(context.Background(), Key1, cas1)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v1, v2, "value changed when it shouldn't: %s, %s", v1, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
 
 	// retrieve value with bad CAS...
-	v3, _, cas1, err := c.getCAS(Key1, cas1+1)
+	v3, _, cas1, err := c.getCAS(context.Background(), Key1, cas1+1)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v3, v2, "value changed when it shouldn't: %s, %s", v3, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
 
 	// really make sure CAS is bad (above could be an off by one bug...)
-	v4, _, cas1, err := c.getCAS(Key1, cas1+992313128)
+	v4, _, cas1, err := c.getCAS(context.Background(), Key1, cas1+992313128)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v4, v2, "value changed when it shouldn't: %s, %s", v4, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
@@ -1329,16 +1330,13 @@ func TestThreaded(t *testing.T) {
 }
 
 func testAdvGet(t *testing.T, c *Client, op opCode, key string, expKey string, opq uint32) *msg {
-	var flags uint32
-
 	m := &msg{
 		header: header{
 			Op:     op,
 			CAS:    uint64(0),
 			Opaque: uint32(opq),
 		},
-		oextras: []interface{}{&flags},
-		key:     key,
+		key: key,
 	}
 
 	err := c.perform(m)
@@ -1400,7 +1398,6 @@ func TestGetExotic(t *testing.T) {
 
 func testAdvGat(t *testing.T, c *Client, op opCode, key string, expKey string, opq uint32) *msg {
 	var exp uint32
-	var flags uint32
 
 	m := &msg{
 		header: header{
@@ -1408,8 +1405,7 @@ func testAdvGat(t *testing.T, c *Client, op opCode, key string, expKey string, o
 			CAS:    uint64(0),
 			Opaque: uint32(opq),
 		},
-		iextras: []interface{}{exp},
-		oextras: []interface{}{&flags},
+		iextras: touchExtras{exp},
 		key:     key,
 	}
 
@@ -1614,7 +1610,7 @@ func TestGetServer(t *testing.T) {
 	c := NewMC(mcAddr+","+badAddr, user, pass)
 	c.servers[1].isAlive = false
 
-	s, e := c.getServer("ok")
+	s, e := c.getServer("ok", false)
 	assertEqualf(t, nil, e, "err was not nil")
 	assertEqualf(t, mcAddr, s.address, "address of incorrect server returned")
 }
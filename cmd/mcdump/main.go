@@ -0,0 +1,96 @@
+// Command mcdump pretty-prints the frames recorded with the WireRecorder
+// option of the mc client, one frame per line:
+//
+//	mcdump [-values n] [file]
+//
+// It reads the recording from file, or from standard input if no file is
+// given.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/memcachier/mc/v3"
+)
+
+func main() {
+	values := flag.Int("values", 32, "bytes of each value to print, -1 for all")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mcdump [-values n] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mcdump:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for {
+		rec, err := mc.ReadWireRecord(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			w.Flush()
+			fmt.Fprintln(os.Stderr, "mcdump:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(w, format(rec, *values))
+	}
+}
+
+// format returns the line describing rec, printing at most values bytes of its
+// value.
+func format(rec *mc.WireRecord, values int) string {
+	dir, status := "<-", " status="+rec.StatusName()
+	if rec.Sent {
+		dir, status = "->", ""
+		if rec.Status != 0 {
+			status = " vbucket=" + strconv.Itoa(int(rec.Status))
+		}
+	}
+	s := fmt.Sprintf("%s %s %s %s magic=0x%02x opaque=%d cas=%d%s",
+		rec.Time.Format("2006-01-02T15:04:05.000000"), rec.Server, dir,
+		rec.OpName(), rec.Magic, rec.Opaque, rec.CAS, status)
+	if rec.HeaderOnly {
+		return s + fmt.Sprintf(" keylen=%d extlen=%d bodylen=%d [header only, rejected]",
+			rec.KeyLen, rec.ExtraLen, rec.BodyLen)
+	}
+	if len(rec.Extras) > 0 {
+		s += " extras=" + hex.EncodeToString(rec.Extras)
+	}
+	if len(rec.Key) > 0 {
+		s += " key=" + strconv.Quote(string(rec.Key))
+	}
+	if len(rec.Value) > 0 {
+		val := rec.Value
+		if values >= 0 && len(val) > values {
+			val = val[:values]
+		}
+		s += fmt.Sprintf(" value(%d)=%s", len(rec.Value), strconv.Quote(string(val)))
+		if len(val) < len(rec.Value) {
+			s += "..."
+		}
+	}
+	return s
+}
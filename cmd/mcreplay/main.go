@@ -0,0 +1,74 @@
+// Command mcreplay replays traffic recorded with the TrafficRecorder option of
+// the mc client against memcached servers, and reports latency percentiles
+// and hit rates:
+//
+//	mcreplay -servers host:port[,host:port...] [-speedup x] [-concurrency n] [file]
+//
+// It reads the recording from file, or from standard input if no file is
+// given. Keys hashed by the recorder are replayed as hashed.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/memcachier/mc/v3"
+)
+
+func main() {
+	servers := flag.String("servers", "localhost:11211", "comma separated servers to replay against")
+	username := flag.String("username", "", "SASL username")
+	password := flag.String("password", "", "SASL password")
+	speedup := flag.Float64("speedup", 1, "how much faster than recorded to replay, 0 for as fast as possible")
+	concurrency := flag.Int("concurrency", 16, "maximum number of operations in flight")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mcreplay [flags] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mcreplay:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := mc.DefaultConfig()
+	config.PoolSize = *concurrency
+	c := mc.NewMCwithConfig(*servers, *username, *password, config)
+	defer c.Quit()
+
+	// stop replaying on ^C, still printing the report so far
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+	report, err := c.Replay(ctx, bufio.NewReader(in), mc.ReplayOptions{
+		Speedup:     *speedup,
+		Concurrency: *concurrency,
+	})
+	fmt.Print(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mcreplay:", err)
+		os.Exit(1)
+	}
+}
@@ -3,22 +3,143 @@ package mc
 //
 
 import (
+	"io"
 	"time"
 )
 
 // Config holds the Memcache client configuration. Use DefaultConfig to get
 // an initialized version.
 type Config struct {
-	Hasher     hasher
+	Hasher hasher
+	// Retries is how many times a request to a server is attempted before a
+	// network error is returned, waiting RetryDelay between attempts. Both
+	// are ignored if RetryPolicy is set.
 	Retries    int
 	RetryDelay time.Duration
-	Failover   bool
-	// ConnectionTimeout is currently used to timeout getting connections from
-	// pool, as a sending deadline and as a reading deadline. Worst case this
-	// means a request can take 3 times the ConnectionTimeout.
-	ConnectionTimeout  time.Duration
-	DownRetryDelay     time.Duration
-	PoolSize           int
+	// RetryPolicy decides whether and when requests failing with a network
+	// error are retried, see NewExponentialBackoff. Requests that aren't
+	// idempotent (e.g., increments, appends or requests with a CAS) are not
+	// retried once they may have reached the server.
+	RetryPolicy RetryPolicy
+	// Failover makes a request that got its server ejected try again on the
+	// server now handling its key. Without it servers are never ejected, keys
+	// stay on their own server whatever its errors.
+	Failover bool
+	// FailoverStrategy decides which server handles the keys of a dead
+	// server, see FailoverNextServer, FailoverRehash and FailoverFailFast.
+	FailoverStrategy FailoverStrategy
+	// FailoverWrites allows writes (sets, deletes, increments, ...) to go to
+	// another server while a key's server is dead. Turning it off keeps
+	// failover from leaving stale copies on other servers that reappear once
+	// the dead server is back. Writes then fail instead.
+	FailoverWrites bool
+	// Replicas is the number of servers each key is stored on: the one the
+	// hasher picks and the ones following it. Writes go to all of them, reads
+	// fall back to the next replica on a miss or failure. 0 or 1 disables
+	// replication.
+	Replicas int
+	// WriteQuorum is the number of replicas a write must succeed on for it to
+	// succeed, out of Replicas: a write fails if fewer replicas are live. 0
+	// means all live replicas.
+	WriteQuorum int
+	// ReadRepair adds a value read from a replica to the replicas before it
+	// that didn't have it, with ReadRepairExpiration as its expiration (the
+	// original one isn't known). Values are only repaired if
+	// ReadRepairExpiration is set, so repaired copies can't outlive the
+	// original for good.
+	ReadRepair           bool
+	ReadRepairExpiration uint32
+	// Interceptors wrap every attempt at a request to a server, see
+	// Interceptor.
+	Interceptors []Interceptor
+	// Logger, if set, logs connections, authentication, retries, failovers,
+	// ejections and revivals of servers and protocol errors. At the debug
+	// level, it also logs every frame sent and received, without values. See
+	// NewSlogLogger to log with log/slog.
+	Logger Logger
+	// WireRecorder, if set, gets a copy of every frame sent to and received
+	// from the servers, see WireRecord for the format and cmd/mcdump to
+	// decode it. Values are recorded as is, except for SASL credentials that
+	// are zeroed.
+	WireRecorder io.Writer
+	// TrafficRecorder, if set, records the key operations of the client so
+	// they can be replayed with Client.Replay.
+	TrafficRecorder *TrafficRecorder
+	// Tracer, if set, traces operations, see Tracer. Operations are traced as
+	// part of the span in the context given to the Context variant of each
+	// method (e.g., GetContext).
+	Tracer Tracer
+	// Metrics keeps counters and latency histograms per server and op, see
+	// Client.Metrics.
+	Metrics bool
+	// EjectionPolicy creates the policy deciding when each server is ejected
+	// (marked dead) after network errors. Nil ejects on the first failure.
+	EjectionPolicy func() EjectionPolicy
+	// MaxEjectedFraction caps the fraction of servers that may be ejected at
+	// the same time, so a network blip can't mark the whole cluster dead.
+	// One server can always be ejected, even by a client of a single server.
+	// Failures on a server that can't be ejected are returned to the caller.
+	MaxEjectedFraction float64
+	// BreakerFailures is the number of consecutive network errors (including
+	// timeouts) after which a server's circuit breaker opens, failing requests
+	// to the server right away. Zero disables circuit breakers.
+	BreakerFailures int
+	// BreakerOpenTime is how long a circuit breaker stays open before letting
+	// a trial request through.
+	BreakerOpenTime time.Duration
+	// ConnectionTimeout is the default for DialTimeout, ReadTimeout,
+	// WriteTimeout and PoolTimeout, used for any of them that isn't set.
+	ConnectionTimeout time.Duration
+	// DialTimeout limits establishing the connection to a server.
+	// Authentication then sends requests like any other, each limited by
+	// WriteTimeout and ReadTimeout.
+	DialTimeout time.Duration
+	// ReadTimeout limits waiting for each response from a server.
+	ReadTimeout time.Duration
+	// WriteTimeout limits sending each request to a server.
+	WriteTimeout time.Duration
+	// PoolTimeout limits waiting for a connection from the pool when all of
+	// a server's connections are busy.
+	PoolTimeout time.Duration
+	// OperationTimeout, if set, caps the total time an operation (Get, Set,
+	// ...) takes, including waiting for connections, connecting, all retries
+	// and the requests to other servers made by failovers, replication and
+	// hedging. The other timeouts are cut short as needed to stay within it.
+	OperationTimeout time.Duration
+	// HedgePercentile, if set (e.g., 0.95), enables hedged Gets: a Get that
+	// hasn't been answered after this percentile of the server's recent Get
+	// latencies is sent again over another connection, or to the next replica
+	// with Replicas, and the first answer wins. It is a fraction, values above
+	// 1 are taken as 1. Hedging needs a PoolSize of at least 2.
+	HedgePercentile float64
+	// HedgeDelay is the shortest delay before a Get is hedged. It is also the
+	// delay used until enough latencies were measured.
+	HedgeDelay time.Duration
+	// DownRetryDelay is the longest delay between two probes of a dead
+	// server. See ProbeInterval.
+	DownRetryDelay time.Duration
+	// ProbeInterval is the delay before a dead server is first probed. The
+	// delay doubles after every failed probe, up to DownRetryDelay.
+	ProbeInterval time.Duration
+	// ProbeSuccesses is the number of consecutive successful probes needed
+	// before a dead server is used again.
+	ProbeSuccesses int
+	// IdleProbeInterval, if set, checks connections that have been idle in
+	// the pool for this long with a NOOP, closing them if the check fails.
+	IdleProbeInterval time.Duration
+	// PoolSize is the maximum number of connections to each server.
+	// Connections are opened on demand, a request finding all of them busy
+	// waits (up to PoolTimeout) for one to be returned.
+	PoolSize int
+	// MinIdleConns is the number of idle connections to each (live) server
+	// that are kept open and ready for use.
+	MinIdleConns int
+	// IdleTimeout closes connections that have not been used for this long,
+	// beyond MinIdleConns. Zero means idle connections are never closed.
+	IdleTimeout time.Duration
+	// MaxConnLifetime closes and replaces connections once they have been
+	// around for this long. Zero means connections are reused forever.
+	MaxConnLifetime    time.Duration
 	TcpKeepAlive       bool
 	TcpKeepAlivePeriod time.Duration
 	TcpNoDelay         bool
@@ -26,6 +147,19 @@ type Config struct {
 		Decompress func(value string) (string, error)
 		Compress   func(value string) (string, error)
 	}
+	// ChunkSize enables the large value mode when greater than zero. Values
+	// (after compression) longer than ChunkSize bytes are split into chunks
+	// stored under derived keys and transparently reassembled by Get and GAT.
+	// It should be set a little below the server's item size limit, e.g.
+	// 1000 * 1000 for memcached's default of 1MB. Append and Prepend fail
+	// with ErrInvalidArgs when it is set. Touch then fetches the value, with
+	// a GAT, to find out if it has chunks to touch, so it costs as much as a
+	// Get of up to ChunkSize bytes.
+	ChunkSize int
+	// MaxBodySize is the largest response body (extras, key and value) the
+	// client accepts, anything larger is treated as a protocol error rather
+	// than allocated. Zero means no limit.
+	MaxBodySize int
 }
 
 /*
@@ -33,37 +167,109 @@ DefaultConfig returns a config object populated with the default values.
 The default values currently are:
 
 	config{
-		Hasher:             NewModuloHasher(),
-		Retries:            2,
-		RetryDelay:         200 * time.Millisecond,
-		Failover:           true,
-		ConnectionTimeout:  2 * time.Second,
-		DownRetryDelay:     60 * time.Second,
-		PoolSize:           1,
-		TcpKeepAlive:       true,
-		TcpKeepAlivePeriod: 60 * time.Second,
-		TcpNoDelay:         true,
+		Hasher:               NewModuloHasher(),
+		Retries:              2,
+		RetryDelay:           200 * time.Millisecond,
+		RetryPolicy:          nil,
+		Failover:             true,
+		FailoverStrategy:     FailoverNextServer,
+		FailoverWrites:       true,
+		Replicas:             1,
+		WriteQuorum:          0,
+		ReadRepair:           false,
+		ReadRepairExpiration: 0,
+		Interceptors:         nil,
+		Logger:               nil,
+		Tracer:               nil,
+		WireRecorder:         nil,
+		TrafficRecorder:      nil,
+		Metrics:              false,
+		EjectionPolicy:       func() EjectionPolicy { return NewConsecutiveFailuresPolicy(1) },
+		MaxEjectedFraction:   0.5,
+		BreakerFailures:      0,
+		BreakerOpenTime:      10 * time.Second,
+		ConnectionTimeout:    2 * time.Second,
+		DialTimeout:          0,
+		ReadTimeout:          0,
+		WriteTimeout:         0,
+		PoolTimeout:          0,
+		OperationTimeout:     0,
+		HedgePercentile:      0,
+		HedgeDelay:           10 * time.Millisecond,
+		DownRetryDelay:       60 * time.Second,
+		ProbeInterval:        1 * time.Second,
+		ProbeSuccesses:       2,
+		IdleProbeInterval:    0,
+		PoolSize:             1,
+		MinIdleConns:         0,
+		IdleTimeout:          0,
+		MaxConnLifetime:      0,
+		TcpKeepAlive:         true,
+		TcpKeepAlivePeriod:   60 * time.Second,
+		TcpNoDelay:           true,
 		Compression        struct {
 			Decompress  nil
 			Compress 		nil
 		}
+		ChunkSize:          0,
+		MaxBodySize:        64 * 1024 * 1024,
 	}
 */
 func DefaultConfig() *Config {
 	return &Config{
-		Hasher:             NewModuloHasher(),
-		Retries:            2,
-		RetryDelay:         200 * time.Millisecond,
-		Failover:           true,
-		ConnectionTimeout:  2 * time.Second,
-		DownRetryDelay:     60 * time.Second,
-		PoolSize:           1,
-		TcpKeepAlive:       true,
-		TcpKeepAlivePeriod: 60 * time.Second,
-		TcpNoDelay:         true,
+		Hasher:               NewModuloHasher(),
+		Retries:              2,
+		RetryDelay:           200 * time.Millisecond,
+		RetryPolicy:          nil,
+		Failover:             true,
+		FailoverStrategy:     FailoverNextServer,
+		FailoverWrites:       true,
+		Replicas:             1,
+		WriteQuorum:          0,
+		ReadRepair:           false,
+		ReadRepairExpiration: 0,
+		Interceptors:         nil,
+		Logger:               nil,
+		Tracer:               nil,
+		WireRecorder:         nil,
+		TrafficRecorder:      nil,
+		Metrics:              false,
+		EjectionPolicy:       func() EjectionPolicy { return NewConsecutiveFailuresPolicy(1) },
+		MaxEjectedFraction:   0.5,
+		BreakerFailures:      0,
+		BreakerOpenTime:      10 * time.Second,
+		ConnectionTimeout:    2 * time.Second,
+		DialTimeout:          0,
+		ReadTimeout:          0,
+		WriteTimeout:         0,
+		PoolTimeout:          0,
+		OperationTimeout:     0,
+		HedgePercentile:      0,
+		HedgeDelay:           10 * time.Millisecond,
+		DownRetryDelay:       60 * time.Second,
+		ProbeInterval:        1 * time.Second,
+		ProbeSuccesses:       2,
+		IdleProbeInterval:    0,
+		PoolSize:             1,
+		MinIdleConns:         0,
+		IdleTimeout:          0,
+		MaxConnLifetime:      0,
+		TcpKeepAlive:         true,
+		TcpKeepAlivePeriod:   60 * time.Second,
+		TcpNoDelay:           true,
 		Compression: struct {
 			Decompress func(value string) (string, error)
 			Compress   func(value string) (string, error)
 		}{Decompress: nil, Compress: nil},
+		ChunkSize:   0,
+		MaxBodySize: 64 * 1024 * 1024,
 	}
 }
+
+// timeout returns d, or ConnectionTimeout if d isn't set.
+func (c *Config) timeout(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return c.ConnectionTimeout
+}
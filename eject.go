@@ -0,0 +1,149 @@
+package mc
+
+// Policies deciding when a failing server is ejected (marked dead).
+
+import (
+	"sync"
+	"time"
+)
+
+// EjectionPolicy decides when a server is ejected, i.e., marked dead so its
+// keys go to other servers (see Config.Failover) until health checks revive
+// it. Each server gets its own policy, created by Config.EjectionPolicy, so
+// implementations only track a single server but must be safe for concurrent
+// use.
+type EjectionPolicy interface {
+	// Success records a request that got an answer from the server (which
+	// may still be an error status such as ErrNotFound).
+	Success()
+	// Failure records a request that failed with a network error, after all
+	// retries, and reports whether the server should now be ejected.
+	Failure() bool
+	// Reset forgets all recorded requests. It is called when the server is
+	// revived.
+	Reset()
+}
+
+// consecutiveFailures ejects a server after a number of failures in a row.
+type consecutiveFailures struct {
+	lock     sync.Mutex
+	limit    int
+	failures int
+}
+
+// NewConsecutiveFailuresPolicy returns a policy ejecting a server after n
+// consecutive failed requests. n = 1 ejects a server on the first failure.
+func NewConsecutiveFailuresPolicy(n int) EjectionPolicy {
+	return &consecutiveFailures{limit: n}
+}
+
+func (p *consecutiveFailures) Success() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failures = 0
+}
+
+func (p *consecutiveFailures) Failure() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failures++
+	return p.failures >= p.limit
+}
+
+func (p *consecutiveFailures) Reset() {
+	p.Success()
+}
+
+// errorRateBuckets is the number of buckets the window of an errorRate policy
+// is split in. The window effectively slides in steps of window/buckets.
+const errorRateBuckets = 10
+
+type rateBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// errorRate ejects a server when the fraction of failed requests over a
+// sliding window exceeds a threshold.
+type errorRate struct {
+	lock        sync.Mutex
+	rate        float64
+	window      time.Duration
+	minRequests int
+	buckets     [errorRateBuckets]rateBucket
+}
+
+// NewErrorRatePolicy returns a policy ejecting a server once more than rate
+// (between 0 and 1) of the requests made to it over the last window failed.
+// Nothing is ejected until the window holds at least minRequests requests, so
+// a couple of failures on an idle server don't count as a high error rate.
+func NewErrorRatePolicy(rate float64, window time.Duration, minRequests int) EjectionPolicy {
+	return &errorRate{rate: rate, window: window, minRequests: minRequests}
+}
+
+// bucket returns the bucket for now, clearing it if it's left over from an
+// earlier window. Must hold p.lock.
+func (p *errorRate) bucket(now time.Time) *rateBucket {
+	width := p.window / errorRateBuckets
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Truncate(width)
+	b := &p.buckets[(start.UnixNano()/int64(width))%errorRateBuckets]
+	if !b.start.Equal(start) {
+		*b = rateBucket{start: start}
+	}
+	return b
+}
+
+func (p *errorRate) Success() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.bucket(time.Now()).successes++
+}
+
+func (p *errorRate) Failure() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.bucket(now).failures++
+
+	var successes, failures int
+	for _, b := range p.buckets {
+		if now.Sub(b.start) < p.window {
+			successes += b.successes
+			failures += b.failures
+		}
+	}
+	total := successes + failures
+	return total >= p.minRequests && float64(failures) > p.rate*float64(total)
+}
+
+func (p *errorRate) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.buckets = [errorRateBuckets]rateBucket{}
+}
+
+// eject marks s dead unless that would leave more than
+// Config.MaxEjectedFraction of the servers dead, one server being ejectable
+// whatever the fraction. It reports whether s was ejected by this call.
+func (c *Client) eject(s *server, cause error) bool {
+	c.ejectLock.Lock()
+	defer c.ejectLock.Unlock()
+	dead := 0
+	for _, s := range c.servers {
+		if !s.alive() {
+			dead++
+		}
+	}
+	limit := int(c.config.MaxEjectedFraction * float64(len(c.servers)))
+	if limit < 1 {
+		limit = 1
+	}
+	if dead+1 > limit {
+		return false
+	}
+	return s.changeAlive(false, cause)
+}
@@ -0,0 +1,118 @@
+package mc
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConsecutiveFailuresPolicy(t *testing.T) {
+	p := NewConsecutiveFailuresPolicy(3)
+	assertTruef(t, !p.Failure(), "1 failure shouldn't eject")
+	assertTruef(t, !p.Failure(), "2 failures shouldn't eject")
+	p.Success()
+	assertTruef(t, !p.Failure(), "a success should reset the count")
+	assertTruef(t, !p.Failure(), "2 failures shouldn't eject")
+	assertTruef(t, p.Failure(), "3 consecutive failures should eject")
+	p.Reset()
+	assertTruef(t, !p.Failure(), "reset should forget failures")
+}
+
+func TestErrorRatePolicy(t *testing.T) {
+	p := NewErrorRatePolicy(0.5, 200*time.Millisecond, 4)
+	assertTruef(t, !p.Failure(), "too few requests to eject")
+	assertTruef(t, !p.Failure(), "too few requests to eject")
+	p.Success()
+	p.Success()
+	p.Success()
+	assertTruef(t, !p.Failure(), "3 failures out of 6 requests shouldn't eject")
+	assertTruef(t, p.Failure(), "4 failures out of 7 requests should eject")
+
+	// failures drop out of the window
+	time.Sleep(250 * time.Millisecond)
+	p.Success()
+	p.Success()
+	assertTruef(t, !p.Failure(), "old failures should have left the window")
+
+	p.Reset()
+	for i := 0; i < 3; i++ {
+		assertTruef(t, !p.Failure(), "too few requests to eject after reset")
+	}
+	assertTruef(t, p.Failure(), "4 failures out of 4 requests should eject")
+}
+
+// Test that a server is only ejected once the policy says so
+func TestEjectionPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.EjectionPolicy = func() EjectionPolicy { return NewConsecutiveFailuresPolicy(2) }
+	c := newMockableMC("s1-100,s2-1", "", "", config, newMockConn)
+	defer c.Quit()
+
+	key := "k2" // this key hashes to s1
+	_, _, _, err := c.Get(key)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	assertTruef(t, c.servers[0].alive(), "s1 shouldn't be ejected after 1 failure")
+
+	val, _, _, err := c.Get(key)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, key+",s2,1", val, "expected failover to s2")
+	assertTruef(t, !c.servers[0].alive(), "s1 should be ejected after 2 failures")
+}
+
+// Test that no more than MaxEjectedFraction of the servers are ejected
+func TestMaxEjectedFraction(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.MaxEjectedFraction = 0.5
+	c := newMockableMC("s1-100,s2-100,s3-100,s4-100", "", "", config, newMockConn)
+	defer c.Quit()
+
+	for i := 0; i < 20; i++ {
+		_, _, _, err := c.Get("k" + strconv.Itoa(i))
+		assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	}
+	dead := 0
+	for _, s := range c.servers {
+		if !s.alive() {
+			dead++
+		}
+	}
+	assertEqualf(t, 2, dead, "wrong number of ejected servers")
+}
+
+// Test that servers aren't ejected when keys can't fail over
+func TestNoEjectionWithoutFailover(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.Failover = false
+	c := newMockableMC("s1-2,s2-1", "", "", config, newMockConn)
+	defer c.Quit()
+
+	key := "k2" // this key hashes to s1
+	_, _, _, err := c.Get(key)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	assertTruef(t, c.servers[0].alive(), "s1 shouldn't be ejected without failover")
+
+	val, _, _, err := c.Get(key)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, key+",s1,2", val, "expected the key's own server")
+}
+
+// Test that the only server of a client can be ejected
+func TestEjectSingleServer(t *testing.T) {
+	c := newMockableMC("s1-100", "", "", DefaultConfig(), newMockConn)
+	defer c.Quit()
+
+	_, _, _, err := c.Get("k")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	assertTruef(t, !c.servers[0].alive(), "s1 should be ejected")
+
+	config := DefaultConfig()
+	config.MaxEjectedFraction = 0
+	c = newMockableMC("s1-100", "", "", config, newMockConn)
+	defer c.Quit()
+	_, _, _, err = c.Get("k")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "unexpected error: %v", err)
+	assertTruef(t, !c.servers[0].alive(), "s1 should be ejected with a zero MaxEjectedFraction")
+}
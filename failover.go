@@ -0,0 +1,81 @@
+package mc
+
+// Strategies for where the keys of a dead server go.
+
+// FailoverStrategy decides which server handles the keys of a dead server.
+type FailoverStrategy int
+
+const (
+	// FailoverNextServer sends the keys of a dead server to the next live
+	// server in the server list. Simple, but all of the dead server's load
+	// ends up on a single neighbour.
+	FailoverNextServer FailoverStrategy = iota
+	// FailoverRehash rehashes the keys of a dead server over all the live
+	// servers, spreading its load evenly.
+	FailoverRehash
+	// FailoverFailFast doesn't fail over at all: reads of keys on a dead
+	// server return ErrNotFound (a miss) and writes fail right away.
+	FailoverFailFast
+)
+
+// isWrite says if op changes data on the server.
+func isWrite(op opCode) bool {
+	switch op {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ,
+		opNoop, opVersion, opStat, opQuit, opQuitQ:
+		return false
+	}
+	return true
+}
+
+func errServerDead(s *server) error {
+	return &Error{StatusNetworkError, "Server " + s.address + " currently dead", nil}
+}
+
+func errAllServersDead() error {
+	return &Error{StatusNetworkError, "All server currently dead", nil}
+}
+
+// failoverServer picks the server handling key, whose server (at idx) is dead,
+// according to Config.FailoverStrategy and Config.FailoverWrites.
+func (c *Client) failoverServer(key string, idx uint, write bool) (*server, error) {
+	dead := c.servers[idx]
+	if write && !c.config.FailoverWrites {
+		return nil, errServerDead(dead)
+	}
+
+	switch c.config.FailoverStrategy {
+	case FailoverFailFast:
+		if write {
+			return nil, errServerDead(dead)
+		}
+		return nil, ErrNotFound
+
+	case FailoverRehash:
+		var live []*server
+		for _, s := range c.servers {
+			if s.alive() {
+				live = append(live, s)
+			}
+		}
+		if len(live) == 0 {
+			return nil, errAllServersDead()
+		}
+		// The hash must be independent of the one placing keys on servers, or
+		// the keys of a dead server could all land on the same live one. A
+		// different seed isn't enough: the low bits of FNV-1a only depend on
+		// the low bits of the bytes hashed, so its high bits are used.
+		h := fnv32a("failover:" + key)
+		return live[uint(h>>16)%uint(len(live))], nil
+
+	default:
+		nServers := uint(len(c.servers))
+		for i := uint(1); i < nServers; i++ {
+			s := c.servers[(idx+i)%nServers]
+			if s.alive() {
+				return s, nil
+			}
+		}
+		return nil, errAllServersDead()
+	}
+}
@@ -0,0 +1,111 @@
+package mc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// keysOnServer returns n keys the hasher maps to server idx.
+func keysOnServer(t *testing.T, c *Client, idx uint, n int) []string {
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		key := "key" + strconv.Itoa(i)
+		j, err := c.config.Hasher.getServerIndex(key)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		if j == idx {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// failoverTargets returns which servers answered gets for keys.
+func failoverTargets(t *testing.T, c *Client, keys []string) map[string]int {
+	targets := make(map[string]int)
+	for _, key := range keys {
+		val, _, _, err := c.Get(key)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		targets[strings.Split(val, ",")[1]]++
+	}
+	return targets
+}
+
+func TestFailoverNextServer(t *testing.T) {
+	config := DefaultConfig()
+	c := newMockableMC("s1,s2,s3,s4", "", "", config, newMockConn)
+	defer c.Quit()
+	c.servers[0].changeAlive(false, nil)
+
+	targets := failoverTargets(t, c, keysOnServer(t, c, 0, 20))
+	assertEqualf(t, map[string]int{"s2": 20}, targets, "keys should all go to s2")
+}
+
+func TestFailoverRehash(t *testing.T) {
+	config := DefaultConfig()
+	config.FailoverStrategy = FailoverRehash
+	c := newMockableMC("s1,s2,s3,s4", "", "", config, newMockConn)
+	defer c.Quit()
+	c.servers[0].changeAlive(false, nil)
+
+	targets := failoverTargets(t, c, keysOnServer(t, c, 0, 20))
+	assertEqualf(t, 0, targets["s1"], "no key should go to the dead server")
+	assertEqualf(t, 3, len(targets), "keys should be spread over all live servers")
+
+	// keys of live servers don't move
+	targets = failoverTargets(t, c, keysOnServer(t, c, 1, 5))
+	assertEqualf(t, map[string]int{"s2": 5}, targets, "keys of s2 should stay on s2")
+}
+
+// Test that rehashed keys spread over the live servers even when their count
+// divides the number of servers.
+func TestFailoverRehashSpread(t *testing.T) {
+	config := DefaultConfig()
+	config.FailoverStrategy = FailoverRehash
+	c := newMockableMC("s1,s2,s3,s4", "", "", config, newMockConn)
+	defer c.Quit()
+	c.servers[0].changeAlive(false, nil)
+	c.servers[2].changeAlive(false, nil)
+
+	targets := failoverTargets(t, c, keysOnServer(t, c, 0, 40))
+	assertEqualf(t, 2, len(targets), "keys should be spread over both live servers: %v", targets)
+	assertTruef(t, targets["s2"] >= 10 && targets["s4"] >= 10, "keys should be spread evenly: %v", targets)
+}
+
+func TestFailoverFailFast(t *testing.T) {
+	config := DefaultConfig()
+	config.FailoverStrategy = FailoverFailFast
+	c := newMockableMC("s1,s2", "", "", config, newMockConn)
+	defer c.Quit()
+	c.servers[0].changeAlive(false, nil)
+
+	key := "k2" // this key hashes to s1
+	_, _, _, err := c.Get(key)
+	assertEqualf(t, ErrNotFound, err, "get should miss")
+	_, err = c.Set(key, "val", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "set should fail: %v", err)
+}
+
+func TestFailoverNoWrites(t *testing.T) {
+	config := DefaultConfig()
+	config.FailoverWrites = false
+	c := newMockableMC("s1,s2", "", "", config, newMockConn)
+	defer c.Quit()
+	c.servers[0].changeAlive(false, nil)
+
+	key := "k2" // this key hashes to s1
+	_, err := c.Set(key, "val", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "set should fail: %v", err)
+	err = c.Del(key)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "delete should fail: %v", err)
+	val, _, _, err := c.Get(key)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, key+",s2,1", val, "get should fail over to s2")
+
+	// a write ejecting its server isn't retried elsewhere either
+	c = newMockableMC("s1-100,s2", "", "", config, newMockConn)
+	defer c.Quit()
+	_, err = c.Set(key, "val", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "set should fail: %v", err)
+	assertTruef(t, !c.servers[0].alive(), "s1 should be ejected")
+}
@@ -45,7 +45,9 @@ func TestRetryFailure(t *testing.T) {
 // Test successful failover
 func TestFailoverSuccess(t *testing.T) {
 	config := DefaultConfig()
-	config.DownRetryDelay = 2 * time.Second
+	config.ProbeInterval = 100 * time.Millisecond
+	config.DownRetryDelay = 100 * time.Millisecond
+	config.ProbeSuccesses = 1
 	c := newMockableMC("s1-3,s2-1", "", "", config, newMockConn)
 
 	key := "k2" // this key hashes to s1
@@ -53,8 +55,12 @@ func TestFailoverSuccess(t *testing.T) {
 	// Expected behavior
 	// 1st loop: try to get twice from s1, fails, marks s1 down, tries s2, succeeds
 	// 2nd loop: get from s2 since s1 is still down, succeeds
-	// 3rd loop: get from s1 since it is up again, succeeds
+	// 3rd loop: get from s1 since the 3rd probe revived it, succeeds
 	for i := 0; i < len(res); i++ {
+		if i == 2 {
+			revived := waitUntil(func() bool { return c.servers[0].alive() })
+			assertTruef(t, revived, "s1 should have been revived")
+		}
 		val, flags, cs, err := c.Get(key)
 		if err != nil {
 			t.Errorf("val: %v, flags: %v, cas: %v", val, flags, cs)
@@ -64,6 +70,5 @@ func TestFailoverSuccess(t *testing.T) {
 		if val != expectedVal {
 			t.Fatalf("got wrong value: %v, expected: %v", val, expectedVal)
 		}
-		time.Sleep(1 * time.Second)
 	}
 }
@@ -0,0 +1,429 @@
+package mc
+
+// A small in-process memcached speaking the binary protocol. It lets the tests
+// exercise the real serverConn code without needing a memcached binary.
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeItem struct {
+	val   []byte
+	flags uint32
+	exp   time.Time
+	cas   uint64
+}
+
+type fakeServer struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	items   map[string]*fakeItem
+	cas     uint64
+	maxItem int
+	conns   map[net.Conn]bool
+	nReqs   map[opCode]int
+	// rewrite, if set, can change the encoded response to a request
+	rewrite func(r *fakeReq, resp []byte) []byte
+	// delay, if set, returns how long to wait before handling a request,
+	// without holding up requests on other connections
+	delay func(r *fakeReq) time.Duration
+	// user and pass, if set, are the only credentials accepted
+	user, pass string
+}
+
+// newFakeServer starts a fake memcached server listening on a random local
+// port.
+func newFakeServer(t testing.TB) *fakeServer {
+	return newFakeServerAt(t, "127.0.0.1:0")
+}
+
+// newFakeServerAt starts a fake memcached server listening on addr.
+func newFakeServerAt(t testing.TB, addr string) *fakeServer {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to start fake server: %v", err)
+	}
+	fs := &fakeServer{
+		ln:      ln,
+		items:   make(map[string]*fakeItem),
+		maxItem: 1024 * 1024,
+		conns:   make(map[net.Conn]bool),
+		nReqs:   make(map[opCode]int),
+	}
+	go fs.serve()
+	return fs
+}
+
+func (fs *fakeServer) addr() string {
+	return fs.ln.Addr().String()
+}
+
+// close stops the server and closes all open connections.
+func (fs *fakeServer) close() {
+	fs.ln.Close()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for c := range fs.conns {
+		c.Close()
+	}
+}
+
+// requests returns how many requests with the given op code were received.
+func (fs *fakeServer) requests(op opCode) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.nReqs[op]
+}
+
+// dropConns closes all open client connections, without telling the client.
+func (fs *fakeServer) dropConns() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for c := range fs.conns {
+		c.Close()
+	}
+}
+
+// numConns returns the number of open client connections.
+func (fs *fakeServer) numConns() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return len(fs.conns)
+}
+
+// setRewrite installs a function to tamper with responses.
+func (fs *fakeServer) setRewrite(f func(r *fakeReq, resp []byte) []byte) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.rewrite = f
+}
+
+// setDelay installs a function to slow down requests.
+func (fs *fakeServer) setDelay(f func(r *fakeReq) time.Duration) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.delay = f
+}
+
+// del removes a key directly from the server's storage.
+func (fs *fakeServer) del(key string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.items, key)
+}
+
+// keys returns all keys currently stored.
+func (fs *fakeServer) keys() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var keys []string
+	for k := range fs.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// corrupt flips a byte of the value stored under key.
+func (fs *fakeServer) corrupt(key string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if it, ok := fs.items[key]; ok && len(it.val) > 0 {
+		it.val[0] ^= 0xff
+	}
+}
+
+func (fs *fakeServer) serve() {
+	for {
+		c, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		fs.lock.Lock()
+		fs.conns[c] = true
+		fs.lock.Unlock()
+		go fs.handle(c)
+	}
+}
+
+type fakeReq struct {
+	op     opCode
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	val    []byte
+}
+
+func (fs *fakeServer) handle(c net.Conn) {
+	defer func() {
+		c.Close()
+		fs.lock.Lock()
+		delete(fs.conns, c)
+		fs.lock.Unlock()
+	}()
+
+	hdr := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		if hdr[0] != byte(magicSend) {
+			return
+		}
+		keyLen := int(binary.BigEndian.Uint16(hdr[2:4]))
+		extLen := int(hdr[4])
+		bodyLen := int(binary.BigEndian.Uint32(hdr[8:12]))
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		r := &fakeReq{
+			op:     opCode(hdr[1]),
+			opaque: binary.BigEndian.Uint32(hdr[12:16]),
+			cas:    binary.BigEndian.Uint64(hdr[16:24]),
+			extras: body[:extLen],
+			key:    string(body[extLen : extLen+keyLen]),
+			val:    body[extLen+keyLen:],
+		}
+		fs.lock.Lock()
+		delay := fs.delay
+		fs.lock.Unlock()
+		if delay != nil {
+			time.Sleep(delay(r))
+		}
+		if !fs.dispatch(c, r) {
+			return
+		}
+	}
+}
+
+// reply writes a response for the given request.
+func (fs *fakeServer) reply(w io.Writer, r *fakeReq, status uint16, cas uint64, extras []byte, key string, val []byte) {
+	buf := make([]byte, 24, 24+len(extras)+len(key)+len(val))
+	buf[0] = byte(magicRecv)
+	buf[1] = byte(r.op)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(val)))
+	binary.BigEndian.PutUint32(buf[12:16], r.opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+	if fs.rewrite != nil {
+		buf = fs.rewrite(r, buf)
+	}
+	w.Write(buf)
+}
+
+// lookup returns the live item for key. Must hold fs.lock.
+func (fs *fakeServer) lookup(key string) *fakeItem {
+	it, ok := fs.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.exp.IsZero() && time.Now().After(it.exp) {
+		delete(fs.items, key)
+		return nil
+	}
+	return it
+}
+
+// store saves an item and gives it a new CAS. Must hold fs.lock.
+func (fs *fakeServer) store(key string, it *fakeItem) uint64 {
+	fs.cas++
+	it.cas = fs.cas
+	fs.items[key] = it
+	return it.cas
+}
+
+func fakeExpiry(exp uint32) time.Time {
+	if exp == 0 {
+		return time.Time{}
+	}
+	if exp <= 60*60*24*30 {
+		return time.Now().Add(time.Duration(exp) * time.Second)
+	}
+	return time.Unix(int64(exp), 0)
+}
+
+// dispatch handles a single request, returning false if the connection should
+// be closed.
+func (fs *fakeServer) dispatch(w io.Writer, r *fakeReq) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.nReqs[r.op]++
+
+	status := StatusOK
+	var cas uint64
+	var extras, val []byte
+	key := ""
+	quiet := false
+
+	switch r.op {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ:
+		quiet = r.op == opGetQ || r.op == opGetKQ || r.op == opGATQ || r.op == opGATKQ
+		it := fs.lookup(r.key)
+		if it == nil {
+			status = StatusNotFound
+			break
+		}
+		if r.op == opGAT || r.op == opGATQ || r.op == opGATK || r.op == opGATKQ {
+			it.exp = fakeExpiry(binary.BigEndian.Uint32(r.extras))
+		}
+		extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, it.flags)
+		val, cas = it.val, it.cas
+		if r.op == opGetK || r.op == opGetKQ || r.op == opGATK || r.op == opGATKQ {
+			key = r.key
+		}
+
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		quiet = r.op == opSetQ || r.op == opAddQ || r.op == opReplaceQ
+		it := fs.lookup(r.key)
+		switch {
+		case len(r.val) > fs.maxItem:
+			status = StatusValueTooLarge
+		case (r.op == opAdd || r.op == opAddQ) && it != nil:
+			status = StatusKeyExists
+		case (r.op == opReplace || r.op == opReplaceQ) && it == nil:
+			status = StatusNotFound
+		case r.cas != 0 && it == nil:
+			status = StatusNotFound
+		case r.cas != 0 && it.cas != r.cas:
+			status = StatusKeyExists
+		default:
+			cas = fs.store(r.key, &fakeItem{
+				val:   append([]byte(nil), r.val...),
+				flags: binary.BigEndian.Uint32(r.extras[0:4]),
+				exp:   fakeExpiry(binary.BigEndian.Uint32(r.extras[4:8])),
+			})
+		}
+
+	case opAppend, opAppendQ, opPrepend, opPrependQ:
+		quiet = r.op == opAppendQ || r.op == opPrependQ
+		it := fs.lookup(r.key)
+		switch {
+		case it == nil:
+			status = StatusValueNotStored
+		case r.cas != 0 && it.cas != r.cas:
+			status = StatusKeyExists
+		case r.op == opAppend || r.op == opAppendQ:
+			it.val = append(it.val, r.val...)
+			cas = fs.store(r.key, it)
+		default:
+			it.val = append(append([]byte(nil), r.val...), it.val...)
+			cas = fs.store(r.key, it)
+		}
+
+	case opDelete, opDeleteQ:
+		quiet = r.op == opDeleteQ
+		it := fs.lookup(r.key)
+		switch {
+		case it == nil:
+			status = StatusNotFound
+		case r.cas != 0 && it.cas != r.cas:
+			status = StatusKeyExists
+		default:
+			delete(fs.items, r.key)
+		}
+
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		quiet = r.op == opIncrementQ || r.op == opDecrementQ
+		delta := binary.BigEndian.Uint64(r.extras[0:8])
+		init := binary.BigEndian.Uint64(r.extras[8:16])
+		exp := binary.BigEndian.Uint32(r.extras[16:20])
+		it := fs.lookup(r.key)
+		var n uint64
+		switch {
+		case it == nil && exp == 0xffffffff:
+			status = StatusNotFound
+		case it == nil:
+			n = init
+			cas = fs.store(r.key, &fakeItem{
+				val: []byte(strconv.FormatUint(n, 10)),
+				exp: fakeExpiry(exp),
+			})
+		case r.cas != 0 && it.cas != r.cas:
+			status = StatusKeyExists
+		default:
+			cur, err := strconv.ParseUint(string(it.val), 10, 64)
+			if err != nil {
+				status = StatusNonNumeric
+				break
+			}
+			if r.op == opIncrement || r.op == opIncrementQ {
+				n = cur + delta
+			} else if delta > cur {
+				n = 0
+			} else {
+				n = cur - delta
+			}
+			it.val = []byte(strconv.FormatUint(n, 10))
+			cas = fs.store(r.key, it)
+		}
+		if status == StatusOK {
+			val = make([]byte, 8)
+			binary.BigEndian.PutUint64(val, n)
+		}
+
+	case opTouch:
+		it := fs.lookup(r.key)
+		if it == nil {
+			status = StatusNotFound
+			break
+		}
+		it.exp = fakeExpiry(binary.BigEndian.Uint32(r.extras))
+		cas = it.cas
+
+	case opFlush, opFlushQ:
+		quiet = r.op == opFlushQ
+		fs.items = make(map[string]*fakeItem)
+
+	case opNoop:
+
+	case opVersion:
+		val = []byte("1.6.0-fake")
+
+	case opStat:
+		fs.reply(w, r, StatusOK, 0, nil, "curr_items", []byte(strconv.Itoa(len(fs.items))))
+		fs.reply(w, r, StatusOK, 0, nil, "version", []byte("1.6.0-fake"))
+
+	case opQuit, opQuitQ:
+		if r.op == opQuit {
+			fs.reply(w, r, StatusOK, 0, nil, "", nil)
+		}
+		return false
+
+	case opAuthList:
+		val = []byte("PLAIN")
+
+	case opAuthStart:
+		if fs.user != "" && string(r.val) != "\x00"+fs.user+"\x00"+fs.pass {
+			status = StatusAuthRequired
+		}
+
+	default:
+		status = StatusUnknownCommand
+	}
+
+	if status != StatusOK {
+		extras, val, key, cas = nil, nil, "", 0
+		if status == StatusNotFound && (r.op == opGetQ || r.op == opGetKQ ||
+			r.op == opGATQ || r.op == opGATKQ) {
+			return true
+		}
+		val = []byte(newError(status).Error())
+	} else if quiet && r.op != opGetQ && r.op != opGetKQ && r.op != opGATQ && r.op != opGATKQ {
+		return true
+	}
+	fs.reply(w, r, status, cas, extras, key, val)
+	return true
+}
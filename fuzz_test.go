@@ -0,0 +1,68 @@
+//go:build go1.18
+// +build go1.18
+
+package mc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func FuzzReadInt(f *testing.F) {
+	f.Add("\x00\x00\x00\x00\x00\x00\x00\x2a")
+	f.Add("42")
+	f.Add("42\r\n")
+	f.Add("")
+	f.Add("\xff\x00")
+	f.Fuzz(func(t *testing.T, b string) {
+		n, err := readInt(b)
+		if err != nil {
+			if err.(*Error).Status != StatusProtocolError {
+				t.Fatalf("unexpected error for %q: %v", b, err)
+			}
+			return
+		}
+		if len(b) == 8 && n != binary.BigEndian.Uint64([]byte(b)) {
+			// only digits may be read as ASCII
+			for _, c := range []byte(b) {
+				if (c < '0' || c > '9') && c != ' ' && c != '\t' && c != '\r' && c != '\n' &&
+					c != '\v' && c != '\f' {
+					t.Fatalf("%q read as ASCII %d", b, n)
+				}
+			}
+		}
+	})
+}
+
+// FuzzRecv feeds arbitrary bytes to the response decoder, which must return
+// an error rather than panic or allocate whatever the header claims.
+func FuzzRecv(f *testing.F) {
+	resp := make([]byte, headerLen+4+8)
+	h := header{Magic: magicRecv, Op: opGet, ExtraLen: 4, BodyLen: 12}
+	h.encode(resp)
+	f.Add(resp)
+	f.Add(resp[:10])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			server.Write(data)
+			server.Close()
+		}()
+
+		config := DefaultConfig()
+		config.ConnectionTimeout = time.Second
+		config.MaxBodySize = 1024
+		sc := &serverConn{config: config, conn: client, rd: bufio.NewReader(client)}
+		m := &msg{header: header{Op: opGet}}
+		err := sc.recv(m)
+		if err == nil && m.Magic != magicRecv {
+			t.Fatalf("accepted response with bad magic")
+		}
+	})
+}
@@ -2,23 +2,20 @@ package mc
 
 //
 
-import (
-	"hash"
-	"hash/fnv"
-)
-
 type hasher interface {
 	update(servers []*server)
 	getServerIndex(key string) (uint, error)
+	// clone returns a new hasher of the same kind, with no servers, for a
+	// client with servers of its own.
+	clone() hasher
 }
 
 type moduloHasher struct {
 	nServers uint
-	h32      hash.Hash32
 }
 
 func NewModuloHasher() hasher {
-	var h hasher = &moduloHasher{h32: fnv.New32a()}
+	var h hasher = &moduloHasher{}
 	return h
 }
 
@@ -26,13 +23,61 @@ func (h *moduloHasher) update(servers []*server) {
 	h.nServers = uint(len(servers))
 }
 
+func (h *moduloHasher) clone() hasher {
+	return NewModuloHasher()
+}
+
 func (h *moduloHasher) getServerIndex(key string) (uint, error) {
 	if h.nServers < 1 {
 		return 0, &Error{StatusNetworkError, "No server available", nil}
 	}
 
-	h.h32.Write([]byte(key))
-	defer h.h32.Reset()
+	return uint(fnv32a(key)) % h.nServers, nil
+}
+
+// fnv32a hashes key with 32-bit FNV-1a. Unlike a hash.Hash32 it holds no state,
+// so a hasher can be used by concurrent requests.
+func fnv32a(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// keySampler picks a stable sample of keys, so that all the operations on a
+// sampled key are in the sample. Keys are hashed with a seed of their own, so
+// the sample doesn't follow servers.
+type keySampler struct {
+	seed      string
+	threshold uint32 // keys hashing below are sampled
+	all       bool
+}
 
-	return uint(h.h32.Sum32()) % h.nServers, nil
+// newKeySampler returns a sampler of a fraction sample (between 0 and 1) of
+// keys, hashed with seed.
+func newKeySampler(seed string, sample float64) keySampler {
+	return keySampler{
+		seed:      seed,
+		threshold: uint32(sample * float64(1<<32-1)),
+		all:       sample >= 1,
+	}
+}
+
+// sampled says if key is in the sample. The last bytes of a key barely change
+// the high bits of its FNV hash, so they are mixed first (as in MurmurHash3),
+// or keys differing only in a suffix (e.g., "user:1", "user:2") would be
+// sampled together.
+func (ks keySampler) sampled(key string) bool {
+	if ks.all {
+		return true
+	}
+	h := fnv32a(ks.seed + key)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h < ks.threshold
 }
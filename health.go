@@ -0,0 +1,74 @@
+package mc
+
+// Health checking of servers and pooled connections.
+
+import (
+	"time"
+)
+
+// Health Checks:
+// A server marked dead after a network error is probed in the background with
+// VERSION requests, over a connection of its own. Probes start ProbeInterval
+// apart and back off exponentially, up to DownRetryDelay, while the server
+// keeps failing. The server is only marked alive again after ProbeSuccesses
+// consecutive probes succeed.
+//
+// Separately, if IdleProbeInterval is set, connections to live servers that sit
+// idle in the pool are checked with a NOOP every IdleProbeInterval, so sockets
+// that were silently dropped (e.g., by a firewall or NAT timeout) are closed
+// before a request tries to use them.
+
+// probe sends a single request of the given op (NOOP or VERSION) over c. Any
+// answer from the server, even an error status, means it is up.
+func probe(c mcConn, op opCode) error {
+	m := &msg{
+		header: header{
+			Op: op,
+		},
+	}
+	err := c.perform(m)
+	if err != nil && connBroken(err) {
+		return err
+	}
+	return nil
+}
+
+// revive probes a dead server until it comes back, and then marks it alive.
+// It gives up if the client is closed.
+func (s *server) revive() {
+	delay := s.config.ProbeInterval
+	if delay <= 0 {
+		delay = s.config.DownRetryDelay
+	}
+	maxDelay := s.config.DownRetryDelay
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+
+	c := s.pool.newConn()
+	defer c.close()
+	successes := 0
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-s.pool.done:
+			t.Stop()
+			return
+		}
+
+		if s.recordError(probe(c, opVersion)) != nil {
+			successes = 0
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+		successes++
+		if successes >= s.config.ProbeSuccesses {
+			s.changeAlive(true, nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A dead server is only revived after enough consecutive successful probes.
+func TestReviveNeedsConsecutiveProbes(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.ProbeInterval = 10 * time.Millisecond
+	config.DownRetryDelay = 10 * time.Millisecond
+	config.ProbeSuccesses = 2
+	// s1 answers every second request, so probes never succeed twice in a row
+	c := newMockableMC("s1-2,s2-1", "", "", config, newMockConn)
+	defer c.Quit()
+
+	_, _, _, err := c.Get("k2") // this key hashes to s1
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, !c.servers[0].alive(), "s1 should be dead")
+
+	time.Sleep(200 * time.Millisecond)
+	assertTruef(t, !c.servers[0].alive(), "s1 shouldn't have been revived")
+}
+
+func TestReviveBackoff(t *testing.T) {
+	config := DefaultConfig()
+	config.ProbeInterval = 10 * time.Millisecond
+	config.DownRetryDelay = 40 * time.Millisecond
+	fs := newFakeServer(t)
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	fs.close()
+	s := c.servers[0]
+	s.changeAlive(false, nil)
+	go s.revive()
+
+	// 10 + 20 + 40 + 40 ms, so about 4 probes fit in 150ms
+	time.Sleep(150 * time.Millisecond)
+	restarted := newFakeServerAt(t, fs.addr())
+	defer restarted.close()
+
+	revived := waitUntil(s.alive)
+	assertTruef(t, revived, "server should have been revived")
+	assertEqualf(t, 2, restarted.requests(opVersion), "expected two probes")
+}
+
+// Idle connections that were dropped by the server are found and closed.
+func TestIdleProbe(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 2
+	config.IdleProbeInterval = 20 * time.Millisecond
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+	defer c.Quit()
+
+	c.Warmup(context.Background())
+	assertEqualf(t, 2, c.PoolStats()[fs.addr()].Open, "expected open connections")
+	waitUntil(func() bool { return fs.numConns() == 2 })
+
+	fs.dropConns()
+	closed := waitUntil(func() bool { return c.PoolStats()[fs.addr()].Open == 0 })
+	assertTruef(t, closed, "dropped connections should be closed: %+v", c.PoolStats())
+
+	// live connections pass the probe
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	time.Sleep(100 * time.Millisecond)
+	assertEqualf(t, 1, c.PoolStats()[fs.addr()].Open, "connection should be kept")
+	assertTruef(t, fs.requests(opNoop) > 0, "expected probes")
+}
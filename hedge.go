@@ -0,0 +1,162 @@
+package mc
+
+// Hedged reads, cutting the tail latency of Get.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hedging:
+// If Config.HedgePercentile is set, a Get that hasn't been answered after the
+// given percentile of the server's recent Get latencies is sent a second time,
+// over another pooled connection, and whichever answer arrives first is used.
+// With replication (see Config.Replicas), the second request goes to the next
+// live replica instead, unless the server is the last one, and a miss from
+// either one waits for the other's answer. The losing request is cancelled:
+// its I/O is interrupted, which closes its connection, so it doesn't hold on
+// to a pooled connection. Hedges to the same server need a free connection, so
+// PoolSize should be at least 2.
+
+const (
+	// hedgeSamples is the number of recent latencies kept per server.
+	hedgeSamples = 256
+	// hedgeMinSamples is the number of latencies needed before the percentile
+	// is used rather than Config.HedgeDelay.
+	hedgeMinSamples = 20
+	// hedgeRefresh is how many new latencies trigger recomputing the delay.
+	hedgeRefresh = 16
+)
+
+// latencies tracks the recent Get latencies of a server.
+type latencies struct {
+	lock    sync.Mutex
+	samples [hedgeSamples]time.Duration
+	n       int // samples recorded, ever
+	stale   int // samples recorded since delay was computed
+	delay   time.Duration
+}
+
+func (l *latencies) record(d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.samples[l.n%hedgeSamples] = d
+	l.n++
+	l.stale++
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of the recent latencies,
+// or def if there aren't enough of them yet. A p above 1 (e.g., a percent)
+// is taken as 1, the longest latency.
+func (l *latencies) percentile(p float64, def time.Duration) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.n < hedgeMinSamples {
+		return def
+	}
+	if l.delay == 0 || l.stale >= hedgeRefresh {
+		n := l.n
+		if n > hedgeSamples {
+			n = hedgeSamples
+		}
+		sorted := make([]time.Duration, n)
+		copy(sorted, l.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := n - 1
+		if p < 1 {
+			i = int(p * float64(n-1))
+		}
+		l.delay = sorted[i]
+		l.stale = 0
+	}
+	return l.delay
+}
+
+// hedgeable says if m should be hedged.
+func (c *Client) hedgeable(m *msg) bool {
+	return c.config.HedgePercentile > 0 && m.Op == opGet
+}
+
+type hedgeResult struct {
+	m      *msg
+	err    error
+	hedged bool
+}
+
+// hedgeTarget returns the server a Get of m sent to s is hedged to: the live
+// replica following s with replication, s itself otherwise.
+func (c *Client) hedgeTarget(s *server, m *msg) *server {
+	if c.config.Replicas <= 1 {
+		return s
+	}
+	replicas, err := c.liveReplicas(m.key)
+	if err != nil {
+		return s
+	}
+	for i := 0; i+1 < len(replicas); i++ {
+		if replicas[i] == s {
+			return replicas[i+1]
+		}
+	}
+	return s
+}
+
+// performHedged performs m, sending it a second time, to target, if the first
+// attempt takes longer than the hedge delay.
+func (s *server) performHedged(m *msg, target *server) error {
+	delay := s.latencies.percentile(s.config.HedgePercentile, s.config.HedgeDelay)
+	if delay < s.config.HedgeDelay {
+		delay = s.config.HedgeDelay
+	}
+
+	// the loser is cancelled once there is a winner, so it doesn't hold on to
+	// its connection
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	send := func(hedged bool) {
+		// each attempt gets its own copy, the loser's is dropped
+		hm := *m
+		hm.ctx = ctx
+		to := s
+		if hedged {
+			to = target
+		}
+		start := time.Now()
+		err := to.perform(&hm)
+		if to == s && (err == nil || !connBroken(err)) {
+			s.latencies.record(time.Since(start))
+		}
+		results <- hedgeResult{&hm, err, hedged}
+	}
+	go send(false)
+
+	timer := time.NewTimer(delay)
+	var r hedgeResult
+	select {
+	case r = <-results:
+		timer.Stop()
+	case <-timer.C:
+		atomic.AddUint64(&s.hedges, 1)
+		go send(true)
+		r = <-results
+		if r.err != nil && (connBroken(r.err) || r.err == ErrNotFound && target != s) {
+			// the other attempt may still work, or find the key
+			r = <-results
+		}
+		if r.hedged {
+			atomic.AddUint64(&s.hedgeWins, 1)
+		}
+	}
+	r.m.ctx = m.ctx
+	*m = *r.m
+	return r.err
+}
@@ -0,0 +1,126 @@
+package mc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentile(t *testing.T) {
+	var l latencies
+	assertEqualf(t, 5*time.Millisecond, l.percentile(0.9, 5*time.Millisecond),
+		"default should be used without samples")
+	for i := 1; i <= 100; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+	assertEqualf(t, 90*time.Millisecond, l.percentile(0.9, 0), "wrong 90th percentile")
+	for i := 0; i < hedgeRefresh; i++ {
+		l.record(time.Millisecond)
+	}
+	assertEqualf(t, 100*time.Millisecond, l.percentile(95, 0), "a percent should be taken as 1")
+
+	// only the most recent samples count
+	for i := 0; i < hedgeSamples; i++ {
+		l.record(time.Millisecond)
+	}
+	assertEqualf(t, time.Millisecond, l.percentile(0.9, 0), "old samples should be dropped")
+}
+
+func TestHedgedGet(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 2
+	config.HedgePercentile = 0.9
+	config.HedgeDelay = 20 * time.Millisecond
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// the first get is stuck, its hedge isn't
+	var gets int32
+	fs.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opGet && atomic.AddInt32(&gets, 1) == 1 {
+			return 300 * time.Millisecond
+		}
+		return 0
+	})
+
+	start := time.Now()
+	val, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", val, "wrong value")
+	assertTruef(t, time.Since(start) < 200*time.Millisecond,
+		"hedged get took too long: %v", time.Since(start))
+	state := c.Servers()[0]
+	assertEqualf(t, uint64(1), state.Hedges, "wrong number of hedges")
+	assertEqualf(t, uint64(1), state.HedgeWins, "wrong number of hedge wins")
+
+	// fast gets aren't hedged
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(1), c.Servers()[0].Hedges, "fast get shouldn't be hedged")
+}
+
+// Test that the loser of a hedged Get gives up its connection.
+func TestHedgedGetReleasesLoser(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 2
+	config.HedgePercentile = 0.9
+	config.HedgeDelay = 20 * time.Millisecond
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	var gets int32
+	fs.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opGet && atomic.AddInt32(&gets, 1) == 1 {
+			return time.Second
+		}
+		return 0
+	})
+
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	time.Sleep(50 * time.Millisecond)
+	stats := c.PoolStats()[fs.addr()]
+	assertEqualf(t, stats.Open, stats.Idle, "no connection should be in use: %+v", stats)
+	// only the hedge was answered, the loser is still delayed and wasn't retried
+	assertEqualf(t, 1, fs.requests(opGet), "the loser shouldn't be retried")
+}
+
+func TestHedgedGetReplica(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.HedgePercentile = 0.9
+	config.HedgeDelay = 20 * time.Millisecond
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	replicas := replicaIndexes(t, c, "foo")
+	primary, replica := fss[replicas[0]], fss[replicas[1]]
+	primary.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opGet {
+			return 300 * time.Millisecond
+		}
+		return 0
+	})
+
+	start := time.Now()
+	val, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", val, "wrong value")
+	assertTruef(t, time.Since(start) < 200*time.Millisecond, "get wasn't hedged: %v", time.Since(start))
+	assertEqualf(t, 1, replica.requests(opGet), "the hedge should go to the replica")
+	assertEqualf(t, uint64(1), atomic.LoadUint64(&c.servers[replicas[0]].hedgeWins), "the hedge should win")
+
+	// a miss on the replica waits for the primary
+	replica.del("foo")
+	val, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", val, "wrong value")
+}
@@ -0,0 +1,129 @@
+package mc
+
+// Interceptors, observing and altering requests to servers.
+
+import (
+	"time"
+)
+
+// OpInfo describes one attempt at a request to a server. Op, Key, Server,
+// Attempt and BytesOut are set before the attempt, the other fields once it's
+// done.
+type OpInfo struct {
+	Op       string // e.g. "get", "set", "flush"
+	Key      string // empty for requests without a key and multi-gets
+	Server   string // address of the server
+	Attempt  int    // starting at 1, see Config.RetryPolicy
+	BytesOut int    // size of the request(s)
+	BytesIn  int    // size of the response(s), 0 if none was received
+	Latency  time.Duration
+	Status   uint16 // StatusOK or the status of Err
+	Err      error
+}
+
+// Interceptor wraps each attempt at a request to a server, including those of
+// operations on all servers (Flush, Stats, ...). It gets the attempt's OpInfo
+// and must call next to make the attempt, after which the rest of info is
+// filled in. It may also skip next and return an error of its own, e.g. to
+// inject faults, which must then be an *Error. Interceptors are set with
+// Config.Interceptors, the first one being the outermost.
+type Interceptor func(info *OpInfo, next func() error) error
+
+// intercept runs f, an attempt at the requests reqs with op and key, through
+// the interceptors. f returns the size of the responses received.
+func (s *server) intercept(op opCode, key string, attempt int, reqs []*msg, f func() (int, error)) error {
+	interceptors := s.config.Interceptors
+	if len(interceptors) == 0 && s.metrics == nil && s.config.Tracer == nil {
+		_, err := f()
+		return err
+	}
+
+	info := &OpInfo{
+		Op:       op.String(),
+		Key:      key,
+		Server:   s.address,
+		Attempt:  attempt,
+		BytesOut: requestLen(reqs),
+	}
+	ran := false
+	next := func() error {
+		ran = true
+		start := time.Now()
+		in, err := f()
+		info.Latency = time.Since(start)
+		info.BytesIn = in
+		info.Status = statusOf(err)
+		info.Err = err
+		return err
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func() error {
+			return interceptor(info, inner)
+		}
+	}
+
+	chain := next
+	err := s.traceRequest(reqs[0].ctx, info, len(reqs), func() error {
+		err := chain()
+		if !ran {
+			// an interceptor answered instead, e.g. injecting a fault
+			info.Status, info.Err = statusOf(err), err
+		}
+		return err
+	})
+	if s.metrics != nil {
+		s.metrics.record(info, reqs)
+	}
+	if _, ok := err.(*Error); err != nil && !ok {
+		err = wrapError(StatusUnknownError, err)
+	}
+	return err
+}
+
+// interceptAttempt is attempt, run through the interceptors.
+func (s *server) interceptAttempt(m *msg, attempt int, deadline time.Time) (sent bool, err error) {
+	reqs := []*msg{m}
+	err = s.intercept(m.Op, m.key, attempt, reqs, func() (int, error) {
+		var err error
+		sent, err = s.attempt(m, deadline)
+		return responseLen(reqs, err), err
+	})
+	return sent, err
+}
+
+// requestLen returns the size of the requests reqs, including the NOOP ending
+// a multi-get.
+func requestLen(reqs []*msg) int {
+	n := 0
+	if len(reqs) > 1 {
+		n += headerLen
+	}
+	for _, m := range reqs {
+		n += headerLen + len(m.key) + len(m.val)
+		if m.iextras != nil {
+			n += len(m.iextras.appendTo(nil))
+		}
+	}
+	return n
+}
+
+// responseLen returns the size of the responses to reqs, given the outcome err
+// of the requests.
+func responseLen(reqs []*msg, err error) int {
+	if err != nil && connBroken(err) {
+		return 0
+	}
+	n := 0
+	if len(reqs) > 1 {
+		n += headerLen
+	}
+	for _, m := range reqs {
+		// quiet misses get no response
+		if m.Op == opGetKQ && m.ResvOrStatus == StatusNotFound {
+			continue
+		}
+		n += headerLen + int(m.BodyLen)
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package mc
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var lock sync.Mutex
+	var ops []OpInfo
+	var order []string
+	config := DefaultConfig()
+	config.Interceptors = []Interceptor{
+		func(info *OpInfo, next func() error) error {
+			order = append(order, "outer")
+			err := next()
+			lock.Lock()
+			ops = append(ops, *info)
+			lock.Unlock()
+			return err
+		},
+		func(info *OpInfo, next func() error) error {
+			order = append(order, "inner")
+			return next()
+		},
+	}
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, []string{"outer", "inner"}, order, "wrong interceptor order")
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("missing")
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	err = c.Flush(0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	assertEqualf(t, 4, len(ops), "wrong number of intercepted requests")
+	set, get, miss, flush := ops[0], ops[1], ops[2], ops[3]
+	assertEqualf(t, "set", set.Op, "wrong op")
+	assertEqualf(t, "foo", set.Key, "wrong key")
+	assertEqualf(t, fs.addr(), set.Server, "wrong server")
+	assertEqualf(t, 1, set.Attempt, "wrong attempt")
+	assertEqualf(t, headerLen+8+3+3, set.BytesOut, "wrong request size")
+	assertEqualf(t, headerLen, set.BytesIn, "wrong response size")
+	assertEqualf(t, "get", get.Op, "wrong op")
+	assertEqualf(t, headerLen+4+3, get.BytesIn, "wrong response size")
+	assertTruef(t, get.Latency > 0, "latency should be measured")
+	assertEqualf(t, StatusOK, get.Status, "wrong status")
+	assertEqualf(t, StatusNotFound, miss.Status, "wrong status")
+	assertEqualf(t, ErrNotFound, miss.Err, "wrong error")
+	assertEqualf(t, "flush", flush.Op, "wrong op")
+	assertEqualf(t, "", flush.Key, "flush has no key")
+}
+
+// Test fault injection with an interceptor failing requests, which are retried
+func TestInterceptorFault(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var attempts []int
+	config := DefaultConfig()
+	config.Retries = 3
+	config.RetryDelay = 0
+	config.Metrics = true
+	config.Interceptors = []Interceptor{
+		func(info *OpInfo, next func() error) error {
+			attempts = append(attempts, info.Attempt)
+			if info.Attempt < 3 {
+				return &Error{StatusNetworkError, "injected", nil}
+			}
+			return next()
+		},
+	}
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "set should succeed on the 3rd attempt: %v", err)
+	assertEqualf(t, []int{1, 2, 3}, attempts, "wrong attempts")
+	assertEqualf(t, 1, fs.requests(opSet), "faults shouldn't reach the server")
+
+	// injected faults are counted as failed requests
+	ops := c.Metrics().Servers[0].Ops["set"]
+	assertEqualf(t, uint64(3), ops.Requests, "wrong number of requests")
+	assertEqualf(t, map[uint16]uint64{StatusNetworkError: 2}, ops.Errors, "faults should be errors")
+}
@@ -0,0 +1,57 @@
+package mc
+
+// Logging of connection, server and protocol events, see Config.Logger.
+
+// LogLevel is the importance of a logged event. The levels have the values of
+// the log/slog levels of the same name.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = -4
+	LogInfo  LogLevel = 0
+	LogWarn  LogLevel = 4
+	LogError LogLevel = 8
+)
+
+// Logger logs the events of a client, see Config.Logger. Events are a message
+// followed by alternating keys and values, as with log/slog, for which
+// NewSlogLogger provides a Logger.
+type Logger interface {
+	Log(level LogLevel, msg string, args ...interface{})
+	// Enabled says if events of level are logged, so that costly ones (every
+	// frame, at the debug level) aren't put together for nothing.
+	Enabled(level LogLevel) bool
+}
+
+// log logs an event with the logger of the config, if any.
+func (c *Config) log(level LogLevel, msg string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Log(level, msg, args...)
+	}
+}
+
+// tracing says if frames should be logged, which is done at the debug level.
+func (c *Config) tracing() bool {
+	return c.Logger != nil && c.Logger.Enabled(LogDebug)
+}
+
+// trace logs a frame sent or received. Values are never logged, only their
+// size, and neither are the keys of SASL requests and responses.
+func (sc *serverConn) trace(msg string, h *header, key string, valLen int) {
+	if isAuth(h.Op) {
+		key = "[redacted]"
+	}
+	sc.config.log(LogDebug, msg,
+		"server", sc.address,
+		"op", h.Op.String(),
+		"opaque", h.Opaque,
+		"status", h.ResvOrStatus,
+		"cas", h.CAS,
+		"key", key,
+		"extras_len", h.ExtraLen,
+		"value_len", valLen)
+}
+
+func isAuth(op opCode) bool {
+	return op == opAuthList || op == opAuthStart || op == opAuthStep
+}
@@ -0,0 +1,28 @@
+//go:build go1.21
+// +build go1.21
+
+package mc
+
+// Logging to log/slog, which needs Go 1.21.
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger logging to l.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (sl slogLogger) Log(level LogLevel, msg string, args ...interface{}) {
+	sl.l.Log(context.Background(), slog.Level(level), msg, args...)
+}
+
+func (sl slogLogger) Enabled(level LogLevel) bool {
+	return sl.l.Enabled(context.Background(), slog.Level(level))
+}
@@ -0,0 +1,22 @@
+//go:build go1.21
+// +build go1.21
+
+package mc
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &syncBuffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	assertTruef(t, !l.Enabled(LogDebug), "debug shouldn't be enabled")
+	assertTruef(t, l.Enabled(LogWarn), "warn should be enabled")
+	l.Log(LogDebug, "mc: send", "op", "get")
+	l.Log(LogWarn, "mc: server ejected", "server", "a:1")
+	out := buf.String()
+	assertTruef(t, !strings.Contains(out, "mc: send"), "debug event logged in:\n%s", out)
+	assertTruef(t, strings.Contains(out, `level=WARN msg="mc: server ejected" server=a:1`), "missing event in:\n%s", out)
+}
@@ -0,0 +1,144 @@
+package mc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// textLogger logs events at or above level to buf, a line each, as the text
+// handler of log/slog does.
+type textLogger struct {
+	level LogLevel
+	buf   *syncBuffer
+}
+
+var levelNames = map[LogLevel]string{
+	LogDebug: "DEBUG",
+	LogInfo:  "INFO",
+	LogWarn:  "WARN",
+	LogError: "ERROR",
+}
+
+func (l *textLogger) Log(level LogLevel, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	line := fmt.Sprintf("level=%s msg=%q", levelNames[level], msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.buf.Write([]byte(line + "\n"))
+}
+
+func (l *textLogger) Enabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func testLogger(level LogLevel) (Logger, *syncBuffer) {
+	buf := &syncBuffer{}
+	return &textLogger{level, buf}, buf
+}
+
+func TestLogWireTrace(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.user, fs.pass = "user", "secret-password"
+
+	config := DefaultConfig()
+	logger, buf := testLogger(LogDebug)
+	config.Logger = logger
+	c := NewMCwithConfig(fs.addr(), "user", "secret-password", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "secret-value", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	out := buf.String()
+	for _, s := range []string{
+		"mc: connected",
+		"mc: authenticated",
+		`msg="mc: send" server=` + fs.addr() + ` op=set`,
+		`msg="mc: recv" server=` + fs.addr() + ` op=get`,
+		"key=foo",
+		"value_len=12",
+		"op=sasl_auth",
+		"key=[redacted]",
+	} {
+		assertTruef(t, strings.Contains(out, s), "missing %q in:\n%s", s, out)
+	}
+	for _, s := range []string{"secret-value", "secret-password"} {
+		assertTruef(t, !strings.Contains(out, s), "%q leaked in:\n%s", s, out)
+	}
+}
+
+func TestLogEvents(t *testing.T) {
+	fs := newFakeServer(t)
+	addr := fs.addr()
+
+	config := DefaultConfig()
+	config.Retries = 2
+	config.RetryDelay = 0
+	config.ProbeInterval = 0
+	logger, buf := testLogger(LogInfo)
+	config.Logger = logger
+	c := NewMCwithConfig(addr+",127.0.0.1:1", "", "", config)
+	defer c.Quit()
+
+	key := keysOnServer(t, c, 0, 1)[0]
+	_, err := c.Set(key, "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	fs.close()
+	c.Set(key, "bar", 0, 0, 0)
+
+	out := buf.String()
+	assertTruef(t, !strings.Contains(out, "mc: send"), "frames should only be logged at the debug level")
+	for _, s := range []string{
+		`level=INFO msg="mc: connected" server=` + addr,
+		`level=WARN msg="mc: network error, resetting connection" server=` + addr,
+		`level=WARN msg="mc: retrying request" server=` + addr + " op=set attempt=1",
+		`level=WARN msg="mc: server ejected" server=` + addr,
+	} {
+		assertTruef(t, strings.Contains(out, s), "missing %q in:\n%s", s, out)
+	}
+}
+
+func TestLogAuthFailure(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.user, fs.pass = "user", "right"
+
+	config := DefaultConfig()
+	logger, buf := testLogger(LogInfo)
+	config.Logger = logger
+	c := NewMCwithConfig(fs.addr(), "user", "wrong", config)
+	defer c.Quit()
+
+	_, _, _, err := c.Get("foo")
+	assertTruef(t, err != nil, "get should fail")
+	out := buf.String()
+	assertTruef(t, strings.Contains(out, `level=ERROR msg="mc: authentication failed"`), "missing auth failure in:\n%s", out)
+	assertTruef(t, !strings.Contains(out, "wrong"), "password leaked in:\n%s", out)
+}
@@ -0,0 +1,449 @@
+package mc
+
+// Client metrics: counters and latency histograms per server and op, along with
+// their Prometheus text exposition and expvar publication.
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of latency histograms.
+var LatencyBuckets = []time.Duration{
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+}
+
+// Metrics is a snapshot of the metrics of a client, see Config.Metrics.
+type Metrics struct {
+	Servers []ServerMetrics
+	// CompressionIn and CompressionOut are the sizes of the values before and
+	// after compression, see Config.Compression.
+	CompressionIn  uint64
+	CompressionOut uint64
+	// Migration is only set for a migrating client, see NewMigratingMC.
+	Migration *MigrationStats `json:",omitempty"`
+	// Shadow is only set for a shadowed client, see NewShadowedMC.
+	Shadow *ShadowStats `json:",omitempty"`
+}
+
+// CompressionRatio returns the size of compressed values relative to their
+// original size, 0 if nothing was compressed.
+func (m *Metrics) CompressionRatio() float64 {
+	if m.CompressionIn == 0 {
+		return 0
+	}
+	return float64(m.CompressionOut) / float64(m.CompressionIn)
+}
+
+// ServerMetrics are the metrics of one server.
+type ServerMetrics struct {
+	ServerState
+	// Ops holds the metrics of each op sent to the server, by op name (see
+	// OpInfo.Op).
+	Ops       map[string]OpMetrics
+	Retries   uint64 // attempts after the first one, see Config.RetryPolicy
+	Failovers uint64 // requests sent to another server while this one was dead
+}
+
+// OpMetrics are the metrics of one op on one server. Every attempt counts as a
+// request.
+type OpMetrics struct {
+	Requests uint64
+	// Hits and Misses count the keys found and not found by gets.
+	Hits   uint64
+	Misses uint64
+	// Errors counts the failed requests by status, not counting misses.
+	Errors   map[uint16]uint64
+	BytesOut uint64
+	BytesIn  uint64
+	Latency  Histogram
+}
+
+// Histogram is a latency histogram. Counts[i] is the number of latencies of
+// at most LatencyBuckets[i], so counts are cumulative as in Prometheus.
+type Histogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(LatencyBuckets))
+	}
+	for i := len(LatencyBuckets) - 1; i >= 0 && d <= LatencyBuckets[i]; i-- {
+		h.Counts[i]++
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// serverMetrics holds the metrics of a server, it is nil if Config.Metrics
+// isn't set.
+type serverMetrics struct {
+	lock      sync.Mutex
+	ops       map[string]*OpMetrics
+	retries   uint64
+	failovers uint64
+}
+
+func newServerMetrics(config *Config) *serverMetrics {
+	if !config.Metrics {
+		return nil
+	}
+	return &serverMetrics{ops: make(map[string]*OpMetrics)}
+}
+
+// record adds the attempt at reqs described by info.
+func (sm *serverMetrics) record(info *OpInfo, reqs []*msg) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	op := sm.ops[info.Op]
+	if op == nil {
+		op = &OpMetrics{Errors: make(map[uint16]uint64)}
+		sm.ops[info.Op] = op
+	}
+	op.Requests++
+	op.BytesOut += uint64(info.BytesOut)
+	op.BytesIn += uint64(info.BytesIn)
+	op.Latency.observe(info.Latency)
+	if info.Attempt > 1 {
+		sm.retries++
+	}
+
+	if len(reqs) == 0 || !isGet(reqs[0].Op) || (info.Err != nil && info.Status != StatusNotFound) {
+		if info.Err != nil {
+			op.Errors[info.Status]++
+		}
+		return
+	}
+	for _, m := range reqs {
+		if m.ResvOrStatus == StatusOK {
+			op.Hits++
+		} else {
+			op.Misses++
+		}
+	}
+}
+
+func (sm *serverMetrics) failover() {
+	if sm == nil {
+		return
+	}
+	sm.lock.Lock()
+	sm.failovers++
+	sm.lock.Unlock()
+}
+
+func (sm *serverMetrics) snapshot(s *server) ServerMetrics {
+	m := ServerMetrics{ServerState: s.state(), Ops: make(map[string]OpMetrics)}
+	if sm == nil {
+		return m
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	m.Retries = sm.retries
+	m.Failovers = sm.failovers
+	for name, op := range sm.ops {
+		snap := *op
+		snap.Errors = make(map[uint16]uint64, len(op.Errors))
+		for status, n := range op.Errors {
+			snap.Errors[status] = n
+		}
+		snap.Latency.Counts = append([]uint64(nil), op.Latency.Counts...)
+		m.Ops[name] = snap
+	}
+	return m
+}
+
+// clientMetrics holds the metrics of a client not tied to a server, it is nil
+// if Config.Metrics isn't set.
+type clientMetrics struct {
+	compressionIn  uint64
+	compressionOut uint64
+}
+
+func newClientMetrics(config *Config) *clientMetrics {
+	if config == nil || !config.Metrics {
+		return nil
+	}
+	return &clientMetrics{}
+}
+
+func (cm *clientMetrics) compressed(in, out int) {
+	if cm == nil {
+		return
+	}
+	atomic.AddUint64(&cm.compressionIn, uint64(in))
+	atomic.AddUint64(&cm.compressionOut, uint64(out))
+}
+
+// isGet says if op retrieves a value, in which case a key not found counts as a
+// miss rather than an error.
+func isGet(op opCode) bool {
+	switch op {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ:
+		return true
+	}
+	return false
+}
+
+// Metrics returns a snapshot of the metrics of the client, which are only kept
+// if Config.Metrics is set. The metrics of a routing, migrating or shadowed
+// client cover the clients it is made of.
+func (c *Client) Metrics() Metrics {
+	var m Metrics
+	for _, s := range c.servers {
+		m.Servers = append(m.Servers, s.metrics.snapshot(s))
+	}
+	for _, cm := range c.clientMetrics() {
+		m.CompressionIn += atomic.LoadUint64(&cm.compressionIn)
+		m.CompressionOut += atomic.LoadUint64(&cm.compressionOut)
+	}
+	if c.migration != nil {
+		st := c.MigrationStats()
+		m.Migration = &st
+	}
+	if c.shadow != nil {
+		st := c.ShadowStats()
+		m.Shadow = &st
+	}
+	return m
+}
+
+// clientMetrics returns the metrics of c and of the clients it is made of.
+func (c *Client) clientMetrics() []*clientMetrics {
+	var all []*clientMetrics
+	if c.metrics != nil {
+		all = append(all, c.metrics)
+	}
+	for _, p := range c.pools {
+		all = append(all, p.client.clientMetrics()...)
+	}
+	if c.migration != nil {
+		all = append(all, c.migration.to.clientMetrics()...)
+		all = append(all, c.migration.from.clientMetrics()...)
+	}
+	if c.shadow != nil {
+		all = append(all, c.shadow.primary.clientMetrics()...)
+	}
+	return all
+}
+
+// PublishExpvar publishes the metrics of the client as the expvar name, as
+// JSON. Like expvar.Publish, it panics if name is already in use.
+func (c *Client) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Metrics()
+	}))
+}
+
+// MetricsHandler returns an http.Handler serving the metrics of the client in
+// the Prometheus text format, each metric name starting with "memcache_".
+func (c *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m := c.Metrics()
+		m.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: w}
+	type opMetric struct {
+		server string
+		op     string
+		*OpMetrics
+	}
+	var ops []opMetric
+	for _, s := range m.Servers {
+		names := make([]string, 0, len(s.Ops))
+		for name := range s.Ops {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			op := s.Ops[name]
+			ops = append(ops, opMetric{s.Address, name, &op})
+		}
+	}
+
+	p.family("memcache_requests_total", "counter", "Requests sent, counting every attempt.")
+	for _, op := range ops {
+		p.sample("memcache_requests_total", float64(op.Requests), "server", op.server, "op", op.op)
+	}
+	p.family("memcache_hits_total", "counter", "Keys found by gets.")
+	for _, op := range ops {
+		if isGetName(op.op) {
+			p.sample("memcache_hits_total", float64(op.Hits), "server", op.server, "op", op.op)
+		}
+	}
+	p.family("memcache_misses_total", "counter", "Keys not found by gets.")
+	for _, op := range ops {
+		if isGetName(op.op) {
+			p.sample("memcache_misses_total", float64(op.Misses), "server", op.server, "op", op.op)
+		}
+	}
+	p.family("memcache_errors_total", "counter", "Failed requests by status.")
+	for _, op := range ops {
+		statuses := make([]int, 0, len(op.Errors))
+		for status := range op.Errors {
+			statuses = append(statuses, int(status))
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			p.sample("memcache_errors_total", float64(op.Errors[uint16(status)]),
+				"server", op.server, "op", op.op, "status", fmt.Sprint(status))
+		}
+	}
+	p.family("memcache_sent_bytes_total", "counter", "Size of the requests sent.")
+	for _, op := range ops {
+		p.sample("memcache_sent_bytes_total", float64(op.BytesOut), "server", op.server, "op", op.op)
+	}
+	p.family("memcache_received_bytes_total", "counter", "Size of the responses received.")
+	for _, op := range ops {
+		p.sample("memcache_received_bytes_total", float64(op.BytesIn), "server", op.server, "op", op.op)
+	}
+	p.family("memcache_request_duration_seconds", "histogram", "Latency of requests.")
+	for _, op := range ops {
+		name := "memcache_request_duration_seconds"
+		for i, bound := range LatencyBuckets {
+			var n uint64
+			if i < len(op.Latency.Counts) {
+				n = op.Latency.Counts[i]
+			}
+			p.sample(name+"_bucket", float64(n), "server", op.server, "op", op.op,
+				"le", fmt.Sprint(bound.Seconds()))
+		}
+		p.sample(name+"_bucket", float64(op.Latency.Count), "server", op.server, "op", op.op, "le", "+Inf")
+		p.sample(name+"_sum", op.Latency.Sum.Seconds(), "server", op.server, "op", op.op)
+		p.sample(name+"_count", float64(op.Latency.Count), "server", op.server, "op", op.op)
+	}
+
+	servers := []struct {
+		name, typ, help string
+		value           func(s *ServerMetrics) float64
+	}{
+		{"memcache_server_up", "gauge", "Whether the server is alive (not ejected).",
+			func(s *ServerMetrics) float64 { return boolValue(s.Alive) }},
+		{"memcache_breaker_state", "gauge", "State of the circuit breaker: 0 closed, 1 open, 2 half-open.",
+			func(s *ServerMetrics) float64 { return float64(s.Breaker) }},
+		{"memcache_retries_total", "counter", "Attempts after the first one.",
+			func(s *ServerMetrics) float64 { return float64(s.Retries) }},
+		{"memcache_failovers_total", "counter", "Requests sent to another server while the server was dead.",
+			func(s *ServerMetrics) float64 { return float64(s.Failovers) }},
+		{"memcache_pool_open_connections", "gauge", "Connections open.",
+			func(s *ServerMetrics) float64 { return float64(s.Pool.Open) }},
+		{"memcache_pool_idle_connections", "gauge", "Connections idle in the pool.",
+			func(s *ServerMetrics) float64 { return float64(s.Pool.Idle) }},
+		{"memcache_pool_waits_total", "counter", "Requests that had to wait for a connection.",
+			func(s *ServerMetrics) float64 { return float64(s.Pool.Waits) }},
+		{"memcache_pool_wait_seconds_total", "counter", "Time spent waiting for a connection.",
+			func(s *ServerMetrics) float64 { return s.Pool.WaitTime.Seconds() }},
+		{"memcache_pool_timeouts_total", "counter", "Requests that gave up waiting for a connection.",
+			func(s *ServerMetrics) float64 { return float64(s.Pool.Timeouts) }},
+		{"memcache_hedges_total", "counter", "Hedged gets sent.",
+			func(s *ServerMetrics) float64 { return float64(s.Hedges) }},
+		{"memcache_hedge_wins_total", "counter", "Hedged gets answered before the original.",
+			func(s *ServerMetrics) float64 { return float64(s.HedgeWins) }},
+	}
+	for _, metric := range servers {
+		p.family(metric.name, metric.typ, metric.help)
+		for i := range m.Servers {
+			p.sample(metric.name, metric.value(&m.Servers[i]), "server", m.Servers[i].Address)
+		}
+	}
+
+	p.family("memcache_compression_in_bytes_total", "counter", "Size of values before compression.")
+	p.sample("memcache_compression_in_bytes_total", float64(m.CompressionIn))
+	p.family("memcache_compression_out_bytes_total", "counter", "Size of values after compression.")
+	p.sample("memcache_compression_out_bytes_total", float64(m.CompressionOut))
+
+	if st := m.Migration; st != nil {
+		p.counter("memcache_migration_reads_total", "Reads of a migrating client.", st.Reads)
+		p.counter("memcache_migration_new_hits_total", "Reads found in the new layout.", st.NewHits)
+		p.counter("memcache_migration_old_reads_total", "Reads falling back to the old layout.", st.OldReads)
+		p.counter("memcache_migration_old_hits_total", "Reads found in the old layout.", st.OldHits)
+		p.counter("memcache_migration_copies_total", "Old layout hits copied to the new layout.", st.Copies)
+	}
+	if st := m.Shadow; st != nil {
+		p.counter("memcache_shadow_mirrored_total", "Requests mirrored to the candidate.", st.Mirrored)
+		p.counter("memcache_shadow_dropped_total", "Requests not mirrored, too many being in flight.", st.Dropped)
+		p.counter("memcache_shadow_status_matches_total", "Mirrored requests with the primary's status.", st.StatusMatches)
+		p.counter("memcache_shadow_status_mismatches_total", "Mirrored requests with another status.", st.StatusMismatches)
+		p.counter("memcache_shadow_candidate_misses_total", "Keys only found on the primary.", st.CandidateMisses)
+		p.counter("memcache_shadow_candidate_only_total", "Keys only found on the candidate.", st.CandidateOnly)
+		p.counter("memcache_shadow_value_mismatches_total", "Keys with different values.", st.ValueMismatches)
+	}
+	return p.err
+}
+
+func isGetName(op string) bool {
+	return strings.HasPrefix(op, "get") || strings.HasPrefix(op, "gat")
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// promWriter writes the Prometheus text format, keeping the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) family(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of metric name, labels being label names and values.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	var b bytes.Buffer
+	b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+		if i+3 >= len(labels) {
+			b.WriteByte('}')
+		}
+	}
+	p.printf("%s %v\n", b.String(), value)
+}
+
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.family(name, "counter", help)
+	p.sample(name, float64(value))
+}
@@ -0,0 +1,99 @@
+package mc
+
+import (
+	"context"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns numbers the expvar names published by tests, which can't be
+// published twice in a process (e.g., with -count=2).
+var expvarRuns int32
+
+func TestMetrics(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	config := DefaultConfig()
+	config.Metrics = true
+	config.Compression.Compress = func(value string) (string, error) {
+		return value[:len(value)/2], nil
+	}
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "barbar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Add("foo", "barbar", 0, 0)
+	assertEqualf(t, StatusKeyExists, err.(*Error).Status, "add should fail: %v", err)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("missing")
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	_, err = c.getMulti(context.Background(), []string{"foo", "missing1", "missing2"})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	m := c.Metrics()
+	assertEqualf(t, 1, len(m.Servers), "wrong number of servers")
+	sm := m.Servers[0]
+	assertEqualf(t, fs.addr(), sm.Address, "wrong server")
+	assertTruef(t, sm.Alive, "server should be alive")
+
+	set := sm.Ops["set"]
+	assertEqualf(t, uint64(1), set.Requests, "wrong set requests")
+	assertEqualf(t, uint64(headerLen+8+3+3), set.BytesOut, "wrong set bytes out")
+	assertEqualf(t, uint64(0), set.Hits+set.Misses, "sets have no hits nor misses")
+	assertEqualf(t, uint64(1), sm.Ops["add"].Errors[StatusKeyExists], "add error should be counted")
+
+	get := sm.Ops["get"]
+	assertEqualf(t, uint64(2), get.Requests, "wrong get requests")
+	assertEqualf(t, uint64(1), get.Hits, "wrong get hits")
+	assertEqualf(t, uint64(1), get.Misses, "wrong get misses")
+	assertEqualf(t, 0, len(get.Errors), "misses aren't errors")
+	assertEqualf(t, uint64(2), get.Latency.Count, "wrong latency count")
+	assertEqualf(t, get.Latency.Count, get.Latency.Counts[len(LatencyBuckets)-1],
+		"latencies should be in the last bucket")
+
+	multi := sm.Ops["getkq"]
+	assertEqualf(t, uint64(1), multi.Hits, "wrong multi-get hits")
+	assertEqualf(t, uint64(2), multi.Misses, "wrong multi-get misses")
+	assertEqualf(t, uint64(2*headerLen+3+4+3), multi.BytesIn, "wrong multi-get bytes in")
+
+	assertEqualf(t, uint64(12), m.CompressionIn, "wrong bytes compressed")
+	assertEqualf(t, 0.5, m.CompressionRatio(), "wrong compression ratio")
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE memcache_requests_total counter",
+		`memcache_requests_total{server="` + fs.addr() + `",op="get"} 2`,
+		`memcache_misses_total{server="` + fs.addr() + `",op="getkq"} 2`,
+		`memcache_errors_total{server="` + fs.addr() + `",op="add",status="2"} 1`,
+		`memcache_request_duration_seconds_bucket{server="` + fs.addr() + `",op="get",le="+Inf"} 2`,
+		`memcache_server_up{server="` + fs.addr() + `"} 1`,
+		"memcache_compression_in_bytes_total 12",
+	} {
+		assertTruef(t, strings.Contains(body, line+"\n"), "missing %q in:\n%s", line, body)
+	}
+
+	name := "mc_test_metrics_" + strconv.Itoa(int(atomic.AddInt32(&expvarRuns, 1)))
+	c.PublishExpvar(name)
+	v := expvar.Get(name).String()
+	assertTruef(t, strings.Contains(v, `"CompressionIn":12`), "wrong expvar: %s", v)
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	c := NewMCwithConfig(fs.addr(), "", "", DefaultConfig())
+	defer c.Quit()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 0, len(c.Metrics().Servers[0].Ops), "no metrics should be kept")
+}
@@ -0,0 +1,268 @@
+package mc
+
+// Dual-write, dual-read migration between two server layouts.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Migration:
+// A migrating client (see NewMigratingMC) fronts the client of the old layout
+// and the client of the new one. Writes go to both. Reads try the new layout
+// first and fall back to the old one on a miss or failure. If copying is on,
+// values found in the old layout only are then added to the new one in the
+// background, so the new layout warms up with the keys actually in use.
+//
+// Sets are written to both layouts, the new layout's answer being the one
+// returned. Deletes are too, and succeed if either layout had the key. Writes
+// whose outcome depends on the current value (Add, Replace, Append, Prepend,
+// Incr, Decr and Touch) first copy the value forward from the old layout if
+// the new one doesn't have it, so they see the key wherever it is: an Add
+// fails and an Incr continues from the old count. They are then made on the
+// new layout and, if they succeed, repeated on the old one.
+//
+// A copy is undone if the value changed or was deleted in the old layout in
+// the meantime, so a copy racing with a Delete can't bring the key back.
+// Copies get the copy expiration of NewMigratingMC, as the original expiration
+// isn't known.
+//
+// CAS values are those of the layout that answered. A write with a CAS is
+// checked against the new layout, or the old one if the new one doesn't have
+// the key, and then written to the other layout without a CAS.
+//
+// MigrationStats tells how many reads each layout answered; once the old
+// layout's hit rate is close to zero, it's safe to cut over.
+
+// MigrationStats counts the reads of a migrating client.
+type MigrationStats struct {
+	Reads    uint64 // reads, all going to the new layout first
+	NewHits  uint64 // reads answered by the new layout
+	OldReads uint64 // reads that fell back to the old layout
+	OldHits  uint64 // reads answered by the old layout
+	Copies   uint64 // values copied from the old layout to the new one
+}
+
+// migration is the state of a migrating client.
+type migration struct {
+	stats MigrationStats // first to be 64-bit aligned for atomic access
+
+	from, to *Client
+	copyHits bool
+	copyExp  uint32
+}
+
+// NewMigratingMC creates a client migrating from the servers of client from
+// (the old layout) to those of client to (the new layout). If copyHits is set,
+// values only found in the old layout are copied to the new one, with copyExp
+// as their expiration (their original one isn't known). Settings applied by
+// the client rather than the servers (Compression and ChunkSize) are taken
+// from the new layout's Config and should be the same for both.
+func NewMigratingMC(from, to *Client, copyHits bool, copyExp uint32) *Client {
+	client := &Client{
+		config:    to.config,
+		metrics:   newClientMetrics(to.config),
+		migration: &migration{from: from, to: to, copyHits: copyHits, copyExp: copyExp},
+	}
+	// operations on all servers cover both layouts
+	client.servers = append(client.servers, to.servers...)
+	client.servers = append(client.servers, from.servers...)
+	for _, c := range []*Client{to, from} {
+		c.OnServerStateChange(client.notifyStateChange)
+		c.OnBreakerStateChange(client.notifyBreakerChange)
+	}
+	return client
+}
+
+// MigrationStats returns the read counters of a migrating client, zero for
+// any other client.
+func (c *Client) MigrationStats() MigrationStats {
+	if c.migration == nil {
+		return MigrationStats{}
+	}
+	st := &c.migration.stats
+	return MigrationStats{
+		Reads:    atomic.LoadUint64(&st.Reads),
+		NewHits:  atomic.LoadUint64(&st.NewHits),
+		OldReads: atomic.LoadUint64(&st.OldReads),
+		OldHits:  atomic.LoadUint64(&st.OldHits),
+		Copies:   atomic.LoadUint64(&st.Copies),
+	}
+}
+
+func (mg *migration) perform(m *msg) error {
+	if isWrite(m.Op) {
+		return mg.write(m)
+	}
+	return mg.read(m)
+}
+
+func (mg *migration) read(m *msg) error {
+	key := m.key
+	atomic.AddUint64(&mg.stats.Reads, 1)
+	nm := *m
+	err := mg.to.perform(&nm)
+	if err == nil || (err != ErrNotFound && !connBroken(err)) {
+		if err == nil {
+			atomic.AddUint64(&mg.stats.NewHits, 1)
+		}
+		*m = nm
+		return err
+	}
+
+	atomic.AddUint64(&mg.stats.OldReads, 1)
+	om := *m
+	oerr := mg.from.perform(&om)
+	if oerr != nil {
+		// report the new layout's error, that's where keys will be
+		*m = nm
+		return err
+	}
+	atomic.AddUint64(&mg.stats.OldHits, 1)
+	*m = om
+	if mg.copyHits && err == ErrNotFound {
+		go func() {
+			// the read is over, the copy mustn't depend on its context
+			if mg.copyForward(context.Background(), key, &om) {
+				atomic.AddUint64(&mg.stats.Copies, 1)
+			}
+		}()
+	}
+	return nil
+}
+
+// copyForward adds om, the value of key read from the old layout, to the new
+// layout. The copy is deleted again if the old layout's value changed in the
+// meantime (e.g., a Delete went to both layouts between the read and the
+// copy). It reports whether the value was copied.
+func (mg *migration) copyForward(ctx context.Context, key string, om *msg) bool {
+	m := &msg{
+		header: header{
+			Op: opAdd,
+		},
+		iextras: setExtras{om.flags, mg.copyExp},
+		key:     key,
+		val:     om.val,
+		ctx:     ctx,
+	}
+	if mg.to.perform(m) != nil {
+		return false
+	}
+	check := &msg{header: header{Op: opGet}, key: key, ctx: ctx}
+	if err := mg.from.perform(check); err == nil && check.CAS == om.CAS {
+		return true
+	}
+	del := &msg{header: header{Op: opDelete, CAS: m.CAS}, key: key, ctx: ctx}
+	mg.to.perform(del)
+	return false
+}
+
+// primeNew copies the value of key forward from the old layout if the new one
+// doesn't have it, for a write that depends on the current value.
+func (mg *migration) primeNew(m *msg) {
+	om := &msg{header: header{Op: opGet}, key: m.key, ctx: m.ctx}
+	if mg.from.perform(om) != nil {
+		return
+	}
+	if mg.copyForward(m.ctx, m.key, om) {
+		atomic.AddUint64(&mg.stats.Copies, 1)
+	}
+}
+
+// conditional says if the outcome of a write op depends on the current value
+// of the key.
+func conditional(op opCode) bool {
+	return op != opSet && op != opDelete
+}
+
+// withoutCAS returns a copy of m that doesn't check the CAS.
+func withoutCAS(m *msg) msg {
+	wm := *m
+	wm.CAS = 0
+	if wm.Op == opReplace {
+		wm.Op = opSet
+	}
+	return wm
+}
+
+func (mg *migration) write(m *msg) error {
+	if m.CAS != 0 {
+		// check the CAS where the key is, then follow in the other layout
+		nm := *m
+		err := mg.to.perform(&nm)
+		if err == ErrNotFound {
+			om := *m
+			if err = mg.from.perform(&om); err != nil {
+				*m = om
+				return err
+			}
+			nm = withoutCAS(m)
+			mg.to.perform(&nm)
+			*m = om
+			return nil
+		}
+		if err == nil {
+			om := withoutCAS(m)
+			mg.from.perform(&om)
+		}
+		*m = nm
+		return err
+	}
+
+	if conditional(m.Op) {
+		mg.primeNew(m)
+		om := *m
+		err := mg.to.perform(m)
+		if err == nil {
+			// errors from the old layout don't matter, it's on its way out
+			mg.from.perform(&om)
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	om := *m
+	var oerr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		oerr = mg.from.perform(&om)
+	}()
+	err := mg.to.perform(m)
+	wg.Wait()
+	if m.Op == opDelete && err == ErrNotFound && oerr == nil {
+		// the key was only in the old layout
+		return nil
+	}
+	return err
+}
+
+// getMulti gets keys from the new layout, falling back to the old one for the
+// keys it doesn't have.
+func (mg *migration) getMulti(ctx context.Context, keys []string) (map[string]*msg, error) {
+	vals, err := mg.to.getMulti(ctx, keys)
+	if err != nil {
+		vals = make(map[string]*msg)
+	}
+	var missing []string
+	for _, key := range keys {
+		if _, ok := vals[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return vals, nil
+	}
+	old, oerr := mg.from.getMulti(ctx, missing)
+	if oerr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return vals, nil
+	}
+	for key, m := range old {
+		vals[key] = m
+	}
+	return vals, nil
+}
@@ -0,0 +1,151 @@
+package mc
+
+import (
+	"context"
+	"testing"
+)
+
+func testInitMigration(t *testing.T, copyHits bool) (*Client, *Client, *fakeServer, *fakeServer) {
+	oldFs, newFs := newFakeServer(t), newFakeServer(t)
+	old := NewMCwithConfig(oldFs.addr(), "", "", DefaultConfig())
+	c := NewMigratingMC(old, NewMCwithConfig(newFs.addr(), "", "", DefaultConfig()), copyHits, 0)
+	return c, old, oldFs, newFs
+}
+
+func TestMigrationWrites(t *testing.T) {
+	c, _, oldFs, newFs := testInitMigration(t, false)
+	defer oldFs.close()
+	defer newFs.close()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, hasKey(oldFs, "foo"), "write should go to the old layout")
+	assertTruef(t, hasKey(newFs, "foo"), "write should go to the new layout")
+
+	err = c.Del("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, !hasKey(oldFs, "foo"), "delete should go to the old layout")
+	assertTruef(t, !hasKey(newFs, "foo"), "delete should go to the new layout")
+}
+
+func TestMigrationReads(t *testing.T) {
+	c, old, oldFs, newFs := testInitMigration(t, true)
+	defer oldFs.close()
+	defer newFs.close()
+
+	_, err := old.Set("cold", "old value", 3, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set("warm", "val", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	val, _, _, err := c.Get("warm")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "val", val, "wrong value")
+	val, flags, _, err := c.Get("cold")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "old value", val, "get should fall back to the old layout")
+	assertEqualf(t, uint32(3), flags, "wrong flags")
+	_, _, _, err = c.Get("missing")
+	assertEqualf(t, ErrNotFound, err, "get should miss")
+
+	copied := waitUntil(func() bool { return c.MigrationStats().Copies == 1 })
+	assertTruef(t, copied, "hit in the old layout should be copied forward")
+	assertTruef(t, hasKey(newFs, "cold"), "new layout should have the copy")
+	assertEqualf(t, MigrationStats{Reads: 3, NewHits: 1, OldReads: 2, OldHits: 1, Copies: 1},
+		c.MigrationStats(), "wrong migration stats")
+}
+
+func TestMigrationCAS(t *testing.T) {
+	c, old, oldFs, newFs := testInitMigration(t, false)
+	defer oldFs.close()
+	defer newFs.close()
+
+	_, err := old.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, cas, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// the CAS is checked in the old layout, which has the key
+	_, err = c.Set("foo", "baz", 0, 0, cas+1)
+	assertEqualf(t, ErrKeyExists, err, "wrong CAS should be rejected")
+	_, err = c.Set("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, hasKey(newFs, "foo"), "CAS write should follow in the new layout")
+	val, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "baz", val, "wrong value")
+}
+
+// Test that writes depending on the current value see keys only in the old
+// layout.
+func TestMigrationConditionalWrites(t *testing.T) {
+	c, old, oldFs, newFs := testInitMigration(t, false)
+	defer oldFs.close()
+	defer newFs.close()
+
+	for _, key := range []string{"add", "replace", "append", "counter", "del"} {
+		val := "old"
+		if key == "counter" {
+			val = "10"
+		}
+		_, err := old.Set(key, val, 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	}
+
+	// an Add fails, a lock held in the old layout is still held
+	_, err := c.Add("add", "new", 0, 0)
+	assertEqualf(t, ErrKeyExists, err, "add should see the old layout's key")
+	val, _, _, err := c.Get("add")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "old", val, "add shouldn't change the value")
+
+	_, err = c.Replace("replace", "new", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "replace should see the old layout's key: %v", err)
+	for _, cl := range []*Client{c, old} {
+		val, _, _, err = cl.Get("replace")
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, "new", val, "wrong replaced value")
+	}
+
+	_, err = c.Append("append", "+new", 0)
+	assertEqualf(t, mcNil, err, "append should see the old layout's key: %v", err)
+	for _, cl := range []*Client{c, old} {
+		val, _, _, err = cl.Get("append")
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, "old+new", val, "wrong appended value")
+	}
+
+	n, _, err := c.Incr("counter", 1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(11), n, "incr should continue from the old count")
+	n, _, err = old.Incr("counter", 0, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(11), n, "incr should be repeated on the old layout")
+
+	// a delete of a key only in the old layout succeeds
+	err = c.Del("del")
+	assertEqualf(t, mcNil, err, "delete should see the old layout's key: %v", err)
+	assertTruef(t, !hasKey(oldFs, "del"), "delete should go to the old layout")
+	err = c.Del("del")
+	assertEqualf(t, ErrNotFound, err, "delete of a missing key should miss")
+}
+
+// Test that a copy racing with a delete doesn't bring the key back.
+func TestMigrationCopyDeleted(t *testing.T) {
+	c, old, oldFs, newFs := testInitMigration(t, true)
+	defer oldFs.close()
+	defer newFs.close()
+
+	_, err := old.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	om := &msg{header: header{Op: opGet}, key: "foo"}
+	err = old.perform(om)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// the delete happens between the read and the copy
+	err = c.Del("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	copied := c.migration.copyForward(context.Background(), "foo", om)
+	assertTruef(t, !copied, "copy of a deleted key should be undone")
+	assertTruef(t, !hasKey(newFs, "foo"), "deleted key shouldn't come back")
+}
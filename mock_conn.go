@@ -5,6 +5,7 @@ package mc
 import (
 	"strconv"
 	"strings"
+	"time"
 )
 
 // mockConn is a mock connection.
@@ -12,7 +13,6 @@ type mockConn struct {
 	serverId   string
 	successMod int
 	counter    int
-	backupMsg  msg
 }
 
 // newMockConn creates a new mockConn which allows for a certain failure pattern
@@ -52,13 +52,25 @@ func (mc *mockConn) performStats(m *msg) (McStats, error) {
 	return nil, nil
 }
 
-func (mc *mockConn) quit(m *msg) {
+func (mc *mockConn) performMulti(ms []*msg) error {
+	for _, m := range ms {
+		err := mc.perform(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (mc *mockConn) backup(m *msg) {
-	backupMsg(m, &mc.backupMsg)
+func (mc *mockConn) open() error {
+	return nil
+}
+
+func (mc *mockConn) close() {
+}
+
+func (mc *mockConn) quit(m *msg) {
 }
 
-func (mc *mockConn) restore(m *msg) {
-	restoreMsg(m, &mc.backupMsg)
+func (mc *mockConn) setDeadline(t time.Time) {
 }
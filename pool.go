@@ -0,0 +1,354 @@
+package mc
+
+// Elastic pool of connections to a single memcached server.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolStats describes the state and usage of the connection pool of a server.
+type PoolStats struct {
+	Open     int           // connections open, idle or in use
+	Idle     int           // connections idle in the pool
+	Waits    uint64        // requests that had to wait for a connection
+	WaitTime time.Duration // total time requests spent waiting
+	Timeouts uint64        // requests that gave up waiting
+}
+
+// pooledConn is a connection along with the bookkeeping the pool needs.
+type pooledConn struct {
+	mcConn
+	created   time.Time
+	idleSince time.Time
+}
+
+// connPool hands out connections to a server. Connections are created on
+// demand up to Config.PoolSize, requests beyond that wait (in order) for a
+// connection to be returned. Idle connections are kept in LIFO order, so the
+// ones at the front of idle are the least recently used.
+type connPool struct {
+	config  *Config
+	newConn func() mcConn
+	done    chan struct{}
+
+	lock    sync.Mutex
+	idle    []*pooledConn
+	open    int
+	waiters []chan *pooledConn
+	closed  bool
+	stats   PoolStats
+}
+
+func newConnPool(config *Config, newConn func() mcConn) *connPool {
+	return &connPool{
+		config:  config,
+		newConn: newConn,
+		done:    make(chan struct{}),
+	}
+}
+
+func errPoolClosed() error {
+	return &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
+}
+
+func errPoolTimeout() error {
+	return &Error{StatusUnknownError,
+		"Timed out while waiting for connection from pool. " +
+			"Maybe increase your pool size?",
+		nil}
+}
+
+// expired says if a connection reached its maximum lifetime.
+func (p *connPool) expired(pc *pooledConn, now time.Time) bool {
+	return p.config.MaxConnLifetime > 0 && now.Sub(pc.created) >= p.config.MaxConnLifetime
+}
+
+// stale says if an idle connection has been unused for too long.
+func (p *connPool) stale(pc *pooledConn, now time.Time) bool {
+	return p.config.IdleTimeout > 0 && now.Sub(pc.idleSince) >= p.config.IdleTimeout
+}
+
+// get takes a connection out of the pool, creating one if none is idle and the
+// pool isn't full yet, and otherwise waiting up to timeout for one to be
+// returned, or until ctx is done.
+func (p *connPool) get(ctx context.Context, timeout time.Duration) (*pooledConn, error) {
+	start := time.Now()
+	var retired []*pooledConn
+	defer func() { closeAll(retired) }()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, errPoolClosed()
+	}
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(pc, start) || p.stale(pc, start) {
+			p.open--
+			retired = append(retired, pc)
+			continue
+		}
+		p.lock.Unlock()
+		return pc, nil
+	}
+	if p.open < p.config.PoolSize {
+		p.open++
+		p.lock.Unlock()
+		return &pooledConn{mcConn: p.newConn(), created: start}, nil
+	}
+	ch := make(chan *pooledConn, 1)
+	p.waiters = append(p.waiters, ch)
+	p.stats.Waits++
+	p.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	var pc *pooledConn
+	select {
+	case pc = <-ch:
+	case <-timer.C:
+		if p.giveUp(ch, start) {
+			return nil, errPoolTimeout()
+		}
+		// a connection was handed over just as we timed out
+		pc = <-ch
+	case <-done:
+		if p.giveUp(ch, start) {
+			return nil, errContext(ctx.Err())
+		}
+		pc = <-ch
+	}
+
+	p.lock.Lock()
+	p.stats.WaitTime += time.Since(start)
+	p.lock.Unlock()
+	if pc == nil {
+		return nil, errPoolClosed()
+	}
+	return pc, nil
+}
+
+// giveUp stops waiting on ch. It returns false if a connection was already
+// handed over on ch, which must then be taken.
+func (p *connPool) giveUp(ch chan *pooledConn, start time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.stats.WaitTime += time.Since(start)
+			p.stats.Timeouts++
+			return true
+		}
+	}
+	return false
+}
+
+// put returns a connection to the pool, handing it straight to the longest
+// waiting request if there is one.
+func (p *connPool) put(pc *pooledConn) {
+	now := time.Now()
+	pc.setDeadline(time.Time{})
+	p.lock.Lock()
+	if p.closed {
+		p.open--
+		p.lock.Unlock()
+		pc.close()
+		return
+	}
+	if p.expired(pc, now) {
+		pc.close()
+		pc = &pooledConn{mcConn: p.newConn(), created: now}
+	}
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.lock.Unlock()
+		ch <- pc
+		return
+	}
+	pc.idleSince = now
+	p.idle = append(p.idle, pc)
+	p.lock.Unlock()
+}
+
+// maintain closes connections that have been idle for too long or reached
+// their maximum lifetime. If the server is alive it then probes connections
+// idle for longer than Config.IdleProbeInterval and opens new connections
+// until Config.MinIdleConns are idle (or the pool is full).
+func (p *connPool) maintain(alive bool) {
+	now := time.Now()
+
+	p.lock.Lock()
+	var retired, probes []*pooledConn
+	idle := p.idle[:0]
+	for i, pc := range p.idle {
+		// idle is ordered least recently used first
+		left := len(p.idle) - i
+		if p.expired(pc, now) || (p.stale(pc, now) && left > p.config.MinIdleConns) {
+			retired = append(retired, pc)
+			continue
+		}
+		if alive && p.config.IdleProbeInterval > 0 &&
+			now.Sub(pc.idleSince) >= p.config.IdleProbeInterval {
+			probes = append(probes, pc)
+			continue
+		}
+		idle = append(idle, pc)
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = idle
+	p.open -= len(retired)
+
+	need := 0
+	if alive && !p.closed {
+		need = p.config.MinIdleConns - len(p.idle)
+		if free := p.config.PoolSize - p.open; need > free {
+			need = free
+		}
+	}
+	if need > 0 {
+		p.open += need
+	}
+	p.lock.Unlock()
+
+	closeAll(retired)
+	for _, pc := range probes {
+		if probe(pc, opNoop) != nil {
+			p.lock.Lock()
+			p.open--
+			p.lock.Unlock()
+			pc.close()
+			continue
+		}
+		p.put(pc)
+	}
+	for i := 0; i < need; i++ {
+		pc := &pooledConn{mcConn: p.newConn(), created: time.Now()}
+		if err := pc.open(); err != nil {
+			// server unreachable, try again next time around
+			p.lock.Lock()
+			p.open -= need - i
+			p.lock.Unlock()
+			return
+		}
+		p.put(pc)
+	}
+}
+
+// warmup fills the pool, opening (i.e., dialing and authenticating) all of its
+// connections. It stops at the first error, or once ctx is done, and returns
+// that error.
+func (p *connPool) warmup(ctx context.Context) error {
+	now := time.Now()
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return errPoolClosed()
+	}
+	conns := p.idle
+	p.idle = nil
+	need := p.config.PoolSize - p.open
+	p.open += need
+	p.lock.Unlock()
+
+	for i := 0; i < need; i++ {
+		conns = append(conns, &pooledConn{mcConn: p.newConn(), created: now})
+	}
+	var err error
+	for _, pc := range conns {
+		if err == nil && ctx.Err() != nil {
+			err = wrapError(StatusNetworkError, ctx.Err())
+		}
+		if err == nil {
+			err = pc.open()
+		}
+		p.put(pc)
+	}
+	return err
+}
+
+// run calls maintain periodically until the pool is closed.
+func (p *connPool) run(interval time.Duration, alive func() bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.maintain(alive())
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// maintenanceInterval returns how often the pool should be maintained, or
+// zero if it doesn't need to be.
+func (p *connPool) maintenanceInterval() time.Duration {
+	if p.config.MinIdleConns == 0 && p.config.IdleTimeout == 0 &&
+		p.config.MaxConnLifetime == 0 && p.config.IdleProbeInterval == 0 {
+		return 0
+	}
+	interval := time.Duration(0)
+	for _, d := range []time.Duration{time.Second, p.config.IdleTimeout / 2,
+		p.config.MaxConnLifetime / 2, p.config.IdleProbeInterval / 2} {
+		if d > 0 && (interval == 0 || d < interval) {
+			interval = d
+		}
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// close closes the pool, sending m (a quit) over all idle connections. Requests
+// waiting for a connection fail and connections in use are closed once they
+// are returned.
+func (p *connPool) close(m *msg) {
+	p.lock.Lock()
+	if p.closed {
+		// Do not double quit
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	idle, waiters := p.idle, p.waiters
+	p.idle, p.waiters = nil, nil
+	p.open -= len(idle)
+	p.lock.Unlock()
+
+	for _, ch := range waiters {
+		ch <- nil
+	}
+	for _, pc := range idle {
+		ms := *m
+		pc.quit(&ms)
+	}
+}
+
+// poolStats returns a snapshot of the pool's state and statistics.
+func (p *connPool) poolStats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.stats
+	stats.Open = p.open
+	stats.Idle = len(p.idle)
+	return stats
+}
+
+func closeAll(conns []*pooledConn) {
+	for _, pc := range conns {
+		pc.close()
+	}
+}
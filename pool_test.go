@@ -0,0 +1,222 @@
+package mc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testPool(config *Config) *connPool {
+	return newConnPool(config, func() mcConn {
+		return newMockConn("s1", "", "", "", config)
+	})
+}
+
+// Connections are only created when needed, up to PoolSize.
+func TestPoolGrowsOnDemand(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 3
+	p := testPool(config)
+
+	assertEqualf(t, 0, p.poolStats().Open, "pool should start empty")
+	var conns []*pooledConn
+	for i := 0; i < 3; i++ {
+		pc, err := p.get(context.Background(), time.Second)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		conns = append(conns, pc)
+	}
+	assertEqualf(t, 3, p.poolStats().Open, "wrong number of open connections")
+
+	_, err := p.get(context.Background(), 10*time.Millisecond)
+	assertTruef(t, err != nil, "expected a timeout with a full pool")
+	stats := p.poolStats()
+	assertEqualf(t, uint64(1), stats.Waits, "wrong waits: %+v", stats)
+	assertEqualf(t, uint64(1), stats.Timeouts, "wrong timeouts: %+v", stats)
+	assertTruef(t, stats.WaitTime >= 10*time.Millisecond, "wrong wait time: %v", stats.WaitTime)
+
+	for _, pc := range conns {
+		p.put(pc)
+	}
+	stats = p.poolStats()
+	assertEqualf(t, 3, stats.Idle, "wrong idle: %+v", stats)
+
+	// idle connections are reused
+	pc, err := p.get(context.Background(), time.Second)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertTruef(t, pc == conns[2], "most recently used connection should be reused")
+}
+
+// A returned connection goes straight to a waiting request.
+func TestPoolHandOff(t *testing.T) {
+	config := DefaultConfig()
+	p := testPool(config)
+
+	pc, err := p.get(context.Background(), time.Second)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pc2, err := p.get(context.Background(), time.Second)
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		assertTruef(t, pc == pc2, "expected the returned connection")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.put(pc)
+	wg.Wait()
+	assertEqualf(t, uint64(1), p.poolStats().Waits, "expected one wait")
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 2
+	config.IdleTimeout = 10 * time.Millisecond
+	p := testPool(config)
+
+	pc1, _ := p.get(context.Background(), time.Second)
+	pc2, _ := p.get(context.Background(), time.Second)
+	p.put(pc1)
+	p.put(pc2)
+	time.Sleep(20 * time.Millisecond)
+	p.maintain(false)
+	stats := p.poolStats()
+	assertEqualf(t, 0, stats.Open, "idle connections should be closed: %+v", stats)
+}
+
+func TestPoolMinIdle(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	config := DefaultConfig()
+	config.PoolSize = 4
+	config.MinIdleConns = 2
+	config.IdleTimeout = 10 * time.Millisecond
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	waitUntil(func() bool { return fs.numConns() == 2 })
+	assertEqualf(t, 2, fs.numConns(), "expected warm connections")
+	stats := c.PoolStats()[fs.addr()]
+	assertEqualf(t, 2, stats.Idle, "wrong idle: %+v", stats)
+
+	// the minimum is kept despite the idle timeout
+	time.Sleep(50 * time.Millisecond)
+	stats = c.PoolStats()[fs.addr()]
+	assertEqualf(t, 2, stats.Idle, "wrong idle: %+v", stats)
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxConnLifetime = 10 * time.Millisecond
+	p := testPool(config)
+
+	pc, _ := p.get(context.Background(), time.Second)
+	time.Sleep(20 * time.Millisecond)
+	p.put(pc)
+	pc2, _ := p.get(context.Background(), time.Second)
+	assertTruef(t, pc != pc2, "connection should have been replaced")
+	assertEqualf(t, 1, p.poolStats().Open, "wrong number of open connections")
+}
+
+// Requests waiting for a connection fail when the pool is closed.
+func TestPoolClose(t *testing.T) {
+	config := DefaultConfig()
+	p := testPool(config)
+
+	pc, _ := p.get(context.Background(), time.Second)
+	done := make(chan error)
+	go func() {
+		_, err := p.get(context.Background(), time.Second)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.close(&msg{header: header{Op: opQuit}})
+	err := <-done
+	assertTruef(t, err != nil, "expected an error from a closed pool")
+
+	p.put(pc)
+	assertEqualf(t, 0, p.poolStats().Open, "connections should be closed")
+	_, err = p.get(context.Background(), time.Second)
+	assertTruef(t, err != nil, "expected an error from a closed pool")
+}
+
+func TestWarmup(t *testing.T) {
+	fs1 := newFakeServer(t)
+	defer fs1.close()
+	fs2 := newFakeServer(t)
+	defer fs2.close()
+
+	config := DefaultConfig()
+	config.PoolSize = 3
+	c := NewMCwithConfig(fs1.addr()+","+fs2.addr(), "", "", config)
+	defer c.Quit()
+
+	report := c.Warmup(context.Background())
+	assertEqualf(t, 2, len(report), "expected a result per server: %v", report)
+	for addr, err := range report {
+		assertEqualf(t, nil, err, "unexpected error for %s: %v", addr, err)
+	}
+	waitUntil(func() bool { return fs1.numConns() == 3 && fs2.numConns() == 3 })
+	assertEqualf(t, 3, fs1.numConns(), "expected a full pool")
+	assertEqualf(t, 3, fs2.numConns(), "expected a full pool")
+	assertEqualf(t, 3, c.PoolStats()[fs1.addr()].Idle, "connections should be idle")
+
+	// warming up again is a no-op
+	c.Warmup(context.Background())
+	assertEqualf(t, 3, fs1.numConns(), "expected a full pool")
+}
+
+func TestWarmupFailures(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.user, fs.pass = "user", "right"
+
+	down := newFakeServer(t)
+	down.close()
+
+	c := NewMCwithConfig(fs.addr()+","+down.addr(), "user", "wrong", DefaultConfig())
+	defer c.Quit()
+
+	report := c.Warmup(context.Background())
+	assertEqualf(t, ErrAuthRequired, report[fs.addr()], "expected an auth error")
+	err := report[down.addr()]
+	assertTruef(t, err != nil, "expected a network error")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a network error: %v", err)
+}
+
+func TestWarmupContext(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	c := NewMCwithConfig(fs.addr(), "", "", DefaultConfig())
+	defer c.Quit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.Warmup(ctx)[fs.addr()]
+	assertTruef(t, err != nil, "expected an error")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a network error: %v", err)
+}
+
+func TestPoolWaitCancel(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 1
+	p := testPool(config)
+
+	pc, err := p.get(context.Background(), time.Second)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = p.get(ctx, time.Minute)
+	assertTruef(t, err != nil, "expected an error once cancelled")
+	assertEqualf(t, context.Canceled, err.(*Error).WrappedError, "wrong wrapped error: %v", err)
+	assertTruef(t, time.Since(start) < time.Second, "waited too long: %v", time.Since(start))
+	assertEqualf(t, 0, len(p.waiters), "waiter left behind")
+	p.put(pc)
+}
@@ -2,6 +2,12 @@ package mc
 
 // Deal with the protocol specification of Memcached.
 
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
 // Error represents a MemCache error (including the status code). All function
 // in mc return error values of this type, despite the functions using the plain
 // error type. You can safely cast all error types returned by mc to *Error. If
@@ -54,6 +60,7 @@ const (
 	StatusOutOfMemory    = uint16(0x82)
 	StatusAuthUnknown    = uint16(0xffff)
 	StatusNetworkError   = uint16(0xfff1)
+	StatusProtocolError  = uint16(0xfff2)
 	StatusUnknownError   = uint16(0xffff)
 )
 
@@ -89,6 +96,12 @@ func newError(status uint16) error {
 	return ErrUnknownError
 }
 
+// protocolError reports a response that doesn't conform to the protocol or
+// doesn't belong to the request it was read for.
+func protocolError(format string, args ...interface{}) error {
+	return &Error{StatusProtocolError, "mc: protocol error: " + fmt.Sprintf(format, args...), nil}
+}
+
 // wrapError wraps an existing error in an Error value.
 func wrapError(status uint16, err error) error {
 	return &Error{status, err.Error(), err}
@@ -133,6 +146,28 @@ const (
 	opGATKQ = opCode(0x24)
 )
 
+var opNames = map[opCode]string{
+	opGet: "get", opSet: "set", opAdd: "add", opReplace: "replace",
+	opDelete: "delete", opIncrement: "incr", opDecrement: "decr",
+	opQuit: "quit", opFlush: "flush", opGetQ: "getq", opNoop: "noop",
+	opVersion: "version", opGetK: "getk", opGetKQ: "getkq",
+	opAppend: "append", opPrepend: "prepend", opStat: "stat",
+	opSetQ: "setq", opAddQ: "addq", opReplaceQ: "replaceq",
+	opDeleteQ: "deleteq", opIncrementQ: "incrq", opDecrementQ: "decrq",
+	opQuitQ: "quitq", opFlushQ: "flushq", opAppendQ: "appendq",
+	opPrependQ: "prependq", opVerbosity: "verbosity", opTouch: "touch",
+	opGAT: "gat", opGATQ: "gatq", opGATK: "gatk", opGATKQ: "gatkq",
+	opAuthList: "sasl_list", opAuthStart: "sasl_auth", opAuthStep: "sasl_step",
+}
+
+// String returns the name of the op, as used by OpInfo.
+func (op opCode) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op_0x%02x", uint8(op))
+}
+
 // Auth Ops
 const (
 	opAuthList opCode = opCode(iota + 0x20)
@@ -162,17 +197,137 @@ type header struct {
 	CAS     uint64 // version really
 }
 
+// headerLen is the size of an encoded header.
+const headerLen = 24
+
+// encode writes the header in network byte order into the first headerLen
+// bytes of b.
+func (h *header) encode(b []byte) {
+	_ = b[headerLen-1] // bounds check hint to compiler
+	b[0] = byte(h.Magic)
+	b[1] = byte(h.Op)
+	binary.BigEndian.PutUint16(b[2:4], h.KeyLen)
+	b[4] = h.ExtraLen
+	b[5] = h.DataType
+	binary.BigEndian.PutUint16(b[6:8], h.ResvOrStatus)
+	binary.BigEndian.PutUint32(b[8:12], h.BodyLen)
+	binary.BigEndian.PutUint32(b[12:16], h.Opaque)
+	binary.BigEndian.PutUint64(b[16:24], h.CAS)
+}
+
+// decode reads the header from the first headerLen bytes of b.
+func (h *header) decode(b []byte) {
+	_ = b[headerLen-1] // bounds check hint to compiler
+	h.Magic = magicCode(b[0])
+	h.Op = opCode(b[1])
+	h.KeyLen = binary.BigEndian.Uint16(b[2:4])
+	h.ExtraLen = b[4]
+	h.DataType = b[5]
+	h.ResvOrStatus = binary.BigEndian.Uint16(b[6:8])
+	h.BodyLen = binary.BigEndian.Uint32(b[8:12])
+	h.Opaque = binary.BigEndian.Uint32(b[12:16])
+	h.CAS = binary.BigEndian.Uint64(b[16:24])
+}
+
+// reqExtras are the command specific extras of a request. Each kind of request
+// has its own type, checkExtras says which op codes take which.
+type reqExtras interface {
+	// appendTo appends the encoded extras to b.
+	appendTo(b []byte) []byte
+}
+
+// setExtras are sent with Set, Add and Replace.
+type setExtras struct {
+	flags uint32
+	exp   uint32
+}
+
+func (e setExtras) appendTo(b []byte) []byte {
+	return appendUint32(appendUint32(b, e.flags), e.exp)
+}
+
+// incrExtras are sent with Incr and Decr.
+type incrExtras struct {
+	delta uint64
+	init  uint64
+	exp   uint32
+}
+
+func (e incrExtras) appendTo(b []byte) []byte {
+	return appendUint32(appendUint64(appendUint64(b, e.delta), e.init), e.exp)
+}
+
+// touchExtras are sent with Touch and GAT.
+type touchExtras struct {
+	exp uint32
+}
+
+func (e touchExtras) appendTo(b []byte) []byte {
+	return appendUint32(b, e.exp)
+}
+
+// flushExtras are (optionally) sent with Flush.
+type flushExtras struct {
+	when uint32
+}
+
+func (e flushExtras) appendTo(b []byte) []byte {
+	return appendUint32(b, e.when)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// checkExtras validates that a request carries the extras its op code expects.
+func checkExtras(op opCode, e reqExtras) error {
+	var ok bool
+	switch op {
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		_, ok = e.(setExtras)
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		_, ok = e.(incrExtras)
+	case opTouch, opGAT, opGATQ, opGATK, opGATKQ:
+		_, ok = e.(touchExtras)
+	case opFlush, opFlushQ:
+		_, ok = e.(flushExtras)
+		ok = ok || e == nil
+	default:
+		ok = e == nil
+	}
+	if !ok {
+		return &Error{StatusInvalidArgs,
+			fmt.Sprintf("mc: invalid extras (%T) for op 0x%02x", e, uint8(op)), nil}
+	}
+	return nil
+}
+
 // Main Memcache message structure
 type msg struct {
-	header                // [0..23]
-	iextras []interface{} // [24..(m-1)] Command specific extras (In)
+	header            // [0..23]
+	iextras reqExtras // [24..(m-1)] Command specific extras (In)
 
-	// Idea of this is we can pass in pointers to values that should appear in the
-	// response extras in this field and the generic send/receive code can handle.
-	oextras []interface{} // [24..(m-1)] Command specifc extras (Out)
+	// The only extras memcached ever responds with are the flags of an item
+	// returned by the GET and GAT family of commands.
+	flags uint32 // [24..27] Item flags (Out)
 
 	key string // [m..(n-1)] Key (as needed, length in header)
 	val string // [n..x] Value (as needed, length in header)
+
+	// chunkOf is the key of the value a chunk request is for, see
+	// Config.ChunkSize
+	chunkOf string
+
+	// ctx is the context of the operation the request is part of: once it is
+	// done, the request is given up, and its deadline caps the request's (see
+	// msg.ctxErr and server.opDeadline). It also holds the span of the
+	// operation, see Config.Tracer.
+	ctx context.Context
 }
 
 // Memcache stats
@@ -0,0 +1,152 @@
+package mc
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestHeaderEncodeDecode(t *testing.T) {
+	h := header{
+		Magic:        magicRecv,
+		Op:           opIncrement,
+		KeyLen:       0x0102,
+		ExtraLen:     20,
+		DataType:     0,
+		ResvOrStatus: StatusKeyExists,
+		BodyLen:      0x01020304,
+		Opaque:       0xf0f0f0f0,
+		CAS:          0x0102030405060708,
+	}
+	var b [headerLen]byte
+	h.encode(b[:])
+	exp := []byte{0x81, 0x05, 0x01, 0x02, 20, 0, 0, 2, 1, 2, 3, 4,
+		0xf0, 0xf0, 0xf0, 0xf0, 1, 2, 3, 4, 5, 6, 7, 8}
+	assertEqualf(t, exp, b[:], "wrong encoding")
+
+	var h2 header
+	h2.decode(b[:])
+	assertEqualf(t, h, h2, "header didn't round trip")
+}
+
+func TestExtrasEncoding(t *testing.T) {
+	b := setExtras{flags: 1, exp: 2}.appendTo(nil)
+	assertEqualf(t, []byte{0, 0, 0, 1, 0, 0, 0, 2}, b, "wrong set extras")
+	b = incrExtras{delta: 1, init: 2, exp: 3}.appendTo(nil)
+	assertEqualf(t, 20, len(b), "wrong incr extras length")
+	assertEqualf(t, byte(3), b[19], "wrong incr extras")
+	b = touchExtras{exp: 0x01020304}.appendTo(nil)
+	assertEqualf(t, []byte{1, 2, 3, 4}, b, "wrong touch extras")
+}
+
+func TestCheckExtras(t *testing.T) {
+	ok := []struct {
+		op opCode
+		e  reqExtras
+	}{
+		{opSet, setExtras{}},
+		{opAddQ, setExtras{}},
+		{opIncrement, incrExtras{}},
+		{opGAT, touchExtras{}},
+		{opTouch, touchExtras{}},
+		{opFlush, flushExtras{}},
+		{opFlush, nil},
+		{opGet, nil},
+		{opDelete, nil},
+	}
+	for _, tc := range ok {
+		err := checkExtras(tc.op, tc.e)
+		assertEqualf(t, nil, err, "unexpected error for op %d: %v", tc.op, err)
+	}
+
+	bad := []struct {
+		op opCode
+		e  reqExtras
+	}{
+		{opSet, nil},
+		{opSet, touchExtras{}},
+		{opIncrement, setExtras{}},
+		{opGet, touchExtras{}},
+		{opTouch, nil},
+	}
+	for _, tc := range bad {
+		err := checkExtras(tc.op, tc.e)
+		assertTruef(t, err != nil, "expected an error for op %d with %T", tc.op, tc.e)
+		assertEqualf(t, StatusInvalidArgs, err.(*Error).Status, "wrong status: %v", err)
+	}
+}
+
+// A request with the wrong extras is refused before anything is sent.
+func TestInvalidExtrasNoPanic(t *testing.T) {
+	c, fs := testInitFake(t, DefaultConfig())
+	defer fs.close()
+
+	m := &msg{
+		header:  header{Op: opSet},
+		iextras: incrExtras{},
+		key:     "foo",
+		val:     "bar",
+	}
+	err := c.perform(m)
+	assertTruef(t, err != nil, "expected an error")
+	assertEqualf(t, StatusInvalidArgs, err.(*Error).Status, "wrong status: %v", err)
+	assertEqualf(t, 0, fs.requests(opSet), "request shouldn't have been sent")
+
+	// connection is still usable
+	_, err = c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+}
+
+func TestReadInt(t *testing.T) {
+	good := map[string]uint64{
+		"\x00\x00\x00\x00\x00\x00\x00\x2a": 42,
+		"\xff\xff\xff\xff\xff\xff\xff\xff": 0xffffffffffffffff,
+		"\x00\x00\x00\x00\x00\x00\x00\x0a": 10,
+		"\t\t\t\t\t\t\t1":                  0x0909090909090931,
+		" 4\r\n    ":                       0x20340d0a20202020,
+		"42":                               42,
+		"42\r\n":                           42,
+		"12345678":                         12345678,
+		"18446744073709551615":             18446744073709551615,
+	}
+	for in, exp := range good {
+		n, err := readInt(in)
+		assertEqualf(t, nil, err, "unexpected error for %q: %v", in, err)
+		assertEqualf(t, exp, n, "wrong value for %q", in)
+	}
+
+	for _, in := range []string{"", "abc", "\x00\x01", "18446744073709551616", "-1"} {
+		_, err := readInt(in)
+		assertTruef(t, err != nil, "expected an error for %q", in)
+		assertEqualf(t, StatusProtocolError, err.(*Error).Status, "wrong status for %q: %v", in, err)
+	}
+}
+
+// replaceValue rewrites the value of an encoded response.
+func replaceValue(resp []byte, val string) []byte {
+	n := headerLen + int(resp[4]) + int(binary.BigEndian.Uint16(resp[2:4]))
+	out := append(append([]byte(nil), resp[:n]...), val...)
+	binary.BigEndian.PutUint32(out[8:12], uint32(len(out)-headerLen))
+	return out
+}
+
+func TestIncrBadResponse(t *testing.T) {
+	c, fs := testInitFake(t, DefaultConfig())
+	defer fs.close()
+
+	val := "\x01\x02\x03"
+	fs.setRewrite(func(r *fakeReq, resp []byte) []byte {
+		if r.op == opIncrement || r.op == opDecrement {
+			return replaceValue(resp, val)
+		}
+		return resp
+	})
+
+	_, _, err := c.Incr("n", 1, 10, 0, 0)
+	assertTruef(t, err != nil, "expected an error")
+	assertEqualf(t, StatusProtocolError, err.(*Error).Status, "expected a protocol error: %v", err)
+
+	val = "11\r\n"
+	n, _, err := c.Decr("n", 1, 10, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(11), n, "wrong counter: %d", n)
+}
@@ -0,0 +1,253 @@
+package mc
+
+// Replay of recorded traffic for load testing, see TrafficRecorder.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayOptions configure Client.Replay.
+type ReplayOptions struct {
+	// Speedup is how much faster than recorded the operations are replayed,
+	// e.g., 2 for twice as fast. 0 replays them as fast as possible.
+	Speedup float64
+	// Concurrency is the maximum number of operations in flight, 1 if not
+	// set. Replay falls behind the recorded pace when it's too low.
+	Concurrency int
+}
+
+// ReplayReport is the outcome of Client.Replay.
+type ReplayReport struct {
+	Duration time.Duration
+	// Ops holds the statistics of each op replayed, by op name (see
+	// OpInfo.Op).
+	Ops map[string]*ReplayOpStats
+	// Lag is how far behind the recorded pace (adjusted by Speedup) the
+	// replay fell at worst.
+	Lag time.Duration
+}
+
+// ReplayOpStats are the statistics of one op of a replay.
+type ReplayOpStats struct {
+	Count  int
+	Errors int // failed operations, not counting misses
+	// Hits and Misses count the keys found and not found by gets and GATs,
+	// RecordedHits and RecordedMisses those of the recording.
+	Hits           int
+	Misses         int
+	RecordedHits   int
+	RecordedMisses int
+	// latency percentiles
+	P50, P90, P99, Max time.Duration
+	// RecordedP50 and RecordedP99 are the latency percentiles of the recording.
+	RecordedP50, RecordedP99 time.Duration
+
+	latencies, recorded []time.Duration
+}
+
+// HitRate returns the fraction of hits among the hits and misses replayed, 0
+// if there were none.
+func (st *ReplayOpStats) HitRate() float64 {
+	return hitRate(st.Hits, st.Misses)
+}
+
+// RecordedHitRate returns the hit rate of the recording.
+func (st *ReplayOpStats) RecordedHitRate() float64 {
+	return hitRate(st.RecordedHits, st.RecordedMisses)
+}
+
+func hitRate(hits, misses int) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// String returns the report as a table, one line per op.
+func (r *ReplayReport) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "replayed in %v, lagging %v at worst\n", r.Duration/time.Millisecond*time.Millisecond, r.Lag/time.Millisecond*time.Millisecond)
+	fmt.Fprintf(&b, "%-8s %8s %6s %9s %9s %9s %9s %9s %9s %9s\n",
+		"op", "count", "errors", "p50", "p90", "p99", "max", "rec p99", "hit rate", "rec rate")
+	ops := make([]string, 0, len(r.Ops))
+	for op := range r.Ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		st := r.Ops[op]
+		fmt.Fprintf(&b, "%-8s %8d %6d %9v %9v %9v %9v %9v",
+			op, st.Count, st.Errors, st.P50, st.P90, st.P99, st.Max, st.RecordedP99)
+		if st.Hits+st.Misses > 0 {
+			fmt.Fprintf(&b, " %8.1f%% %8.1f%%", 100*st.HitRate(), 100*st.RecordedHitRate())
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Replay replays the operations recorded by a TrafficRecorder, read from r,
+// against the servers of the client. Values are replaced by values of the
+// same size. It stops early, returning the report so far along with the
+// error, if ctx is done or r can't be read.
+func (c *Client) Replay(ctx context.Context, r io.Reader, opts ReplayOptions) (*ReplayReport, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	report := &ReplayReport{Ops: make(map[string]*ReplayOpStats)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	recs := make(chan *TrafficRecord)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range recs {
+				start := time.Now()
+				err := c.replay(rec)
+				latency := time.Since(start)
+				lock.Lock()
+				report.add(rec, latency, err)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	var err error
+	for {
+		var rec *TrafficRecord
+		rec, err = ReadTrafficRecord(r)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if opts.Speedup > 0 {
+			at := start.Add(time.Duration(float64(rec.Time) / opts.Speedup))
+			if wait := time.Until(at); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		dispatched := time.Now()
+		recs <- rec
+		if opts.Speedup > 0 {
+			lag := dispatched.Sub(start.Add(time.Duration(float64(rec.Time) / opts.Speedup)))
+			if lag > report.Lag {
+				report.Lag = lag
+			}
+		}
+	}
+	close(recs)
+	wg.Wait()
+	report.Duration = time.Since(start)
+
+	for _, st := range report.Ops {
+		st.P50, st.P90 = percentile(st.latencies, 0.5), percentile(st.latencies, 0.9)
+		st.P99, st.Max = percentile(st.latencies, 0.99), percentile(st.latencies, 1)
+		st.RecordedP50, st.RecordedP99 = percentile(st.recorded, 0.5), percentile(st.recorded, 0.99)
+	}
+	return report, err
+}
+
+// replay performs the operation rec.
+func (c *Client) replay(rec *TrafficRecord) (err error) {
+	switch rec.op {
+	case opGet:
+		_, _, _, err = c.Get(rec.Key)
+	case opGAT:
+		_, _, _, err = c.GAT(rec.Key, rec.Exp)
+	case opTouch:
+		_, err = c.Touch(rec.Key, rec.Exp)
+	case opSet:
+		_, err = c.Set(rec.Key, replayValue(rec.ValueLen), rec.Flags, rec.Exp, 0)
+	case opAdd:
+		_, err = c.Add(rec.Key, replayValue(rec.ValueLen), rec.Flags, rec.Exp)
+	case opReplace:
+		_, err = c.Replace(rec.Key, replayValue(rec.ValueLen), rec.Flags, rec.Exp, 0)
+	case opAppend:
+		_, err = c.Append(rec.Key, replayValue(rec.ValueLen), 0)
+	case opPrepend:
+		_, err = c.Prepend(rec.Key, replayValue(rec.ValueLen), 0)
+	case opIncrement:
+		_, _, err = c.Incr(rec.Key, rec.Delta, rec.Initial, rec.Exp, 0)
+	case opDecrement:
+		_, _, err = c.Decr(rec.Key, rec.Delta, rec.Initial, rec.Exp, 0)
+	case opDelete:
+		err = c.Del(rec.Key)
+	default:
+		err = &Error{StatusUnknownCommand, "mc: can't replay " + rec.Op, nil}
+	}
+	return err
+}
+
+func (r *ReplayReport) add(rec *TrafficRecord, latency time.Duration, err error) {
+	st := r.Ops[rec.Op]
+	if st == nil {
+		st = &ReplayOpStats{}
+		r.Ops[rec.Op] = st
+	}
+	st.Count++
+	st.latencies = append(st.latencies, latency)
+	st.recorded = append(st.recorded, rec.Latency)
+	if isGet(rec.op) {
+		switch rec.Status {
+		case StatusOK:
+			st.RecordedHits++
+		case StatusNotFound:
+			st.RecordedMisses++
+		}
+		if err == nil {
+			st.Hits++
+			return
+		} else if err == ErrNotFound {
+			st.Misses++
+			return
+		}
+	}
+	if err != nil {
+		st.Errors++
+	}
+}
+
+// percentile returns the p-th percentile of latencies, sorting them.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	i := int(p * float64(len(latencies)-1))
+	return latencies[i]
+}
+
+// replayValues holds the bytes replayed values are cut from.
+var replayValues struct {
+	sync.Mutex
+	s string
+}
+
+// replayValue returns a value of n bytes.
+func replayValue(n int) string {
+	replayValues.Lock()
+	defer replayValues.Unlock()
+	if len(replayValues.s) < n {
+		replayValues.s = strings.Repeat("x", n)
+	}
+	return replayValues.s[:n]
+}
@@ -0,0 +1,73 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	recorded, target := newFakeServer(t), newFakeServer(t)
+	defer recorded.close()
+	defer target.close()
+
+	var buf bytes.Buffer
+	tr := NewTrafficRecorder(&buf, 1, []byte("secret"))
+	config := DefaultConfig()
+	config.TrafficRecorder = tr
+	c := NewMCwithConfig(recorded.addr(), "", "", config)
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		c.Set(key, strings.Repeat("v", 100+i), 0, 0, 0)
+		c.Get(key)
+		c.Get("missing" + key)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Get("key0")
+	c.Quit()
+	tr.Flush()
+
+	rc := NewMCwithConfig(target.addr(), "", "", DefaultConfig())
+	defer rc.Quit()
+	start := time.Now()
+	report, err := rc.Replay(context.Background(), bytes.NewReader(buf.Bytes()),
+		ReplayOptions{Speedup: 2, Concurrency: 4})
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertTruef(t, time.Since(start) >= 25*time.Millisecond, "replay should keep the recorded pace")
+
+	assertEqualf(t, 10, target.requests(opSet), "sets should be replayed")
+	assertEqualf(t, 21, target.requests(opGet), "gets should be replayed")
+	for _, key := range target.keys() {
+		assertEqualf(t, 32, len(key), "keys should be replayed hashed")
+	}
+
+	set, get := report.Ops["set"], report.Ops["get"]
+	assertEqualf(t, 10, set.Count, "wrong number of sets")
+	assertEqualf(t, 0, set.Errors, "sets shouldn't fail")
+	assertEqualf(t, 21, get.Count, "wrong number of gets")
+	assertEqualf(t, 11, get.RecordedHits, "wrong recorded hits")
+	assertEqualf(t, 10, get.RecordedMisses, "wrong recorded misses")
+	assertEqualf(t, get.RecordedHitRate(), get.HitRate(), "hit rate should match the recording")
+	assertTruef(t, get.P50 > 0 && get.P50 <= get.P99 && get.P99 <= get.Max, "wrong percentiles")
+	assertTruef(t, strings.Contains(report.String(), "52.4%"), "missing hit rate in:\n%s", report)
+}
+
+func TestReplayCancel(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTrafficRecorder(&buf, 1, nil)
+	tr.start = tr.start.Add(-time.Hour)
+	var err error
+	tr.observe(opGet, "key", 0, nil, time.Now(), &err)
+	tr.Flush()
+
+	c := newMockableMC("s1-1", "", "", DefaultConfig(), newMockConn)
+	defer c.Quit()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report, err := c.Replay(ctx, &buf, ReplayOptions{Speedup: 1})
+	assertEqualf(t, context.DeadlineExceeded, err, "replay should be canceled")
+	assertEqualf(t, 0, len(report.Ops), "nothing should be replayed")
+}
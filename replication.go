@@ -0,0 +1,244 @@
+package mc
+
+// Client-side replication of keys over several servers.
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Replication:
+// If Config.Replicas is more than 1, every key is stored on that many servers:
+// the one the hasher picks (the primary) and the ones following it in the
+// server list. Dead servers are skipped, the replicas take over from them,
+// so Config.FailoverStrategy doesn't apply.
+//
+// Writes go to all live replicas in parallel and succeed once WriteQuorum of
+// them succeeded, failing right away if fewer replicas than that are live.
+// Reads go to the replicas in order until one has the key. If ReadRepair and
+// ReadRepairExpiration are set, the value is then added (in the background) to
+// the replicas before it that missed, so they are warm again after a restart.
+// GATs change the expiration, so like Touch they go to all live replicas in
+// parallel, and answer with the value of the first replica that has the key.
+//
+// Increments, decrements, appends and prepends are applied to each replica
+// independently, so replicas that missed some of them (e.g., while dead, or
+// after being repaired with an older value) drift apart for good. They are
+// best used with a single replica, or with values rewritten by Set.
+//
+// Each server keeps its own CAS values, so they differ between replicas. CAS
+// values returned by the client are those of the first live replica (the
+// primary, unless it is dead) and writes with a CAS are only checked against
+// that replica: if it accepts the write, the value is then written to the
+// other replicas without a CAS. A read answered by a later replica returns
+// that replica's CAS, which the primary will reject with ErrKeyExists or
+// ErrNotFound, the safe outcome.
+
+// replicas returns the servers storing key, primary first.
+func (c *Client) replicas(key string) ([]*server, error) {
+	idx, err := c.config.Hasher.getServerIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	replicas := make([]*server, c.numReplicas())
+	for i := range replicas {
+		replicas[i] = c.servers[(int(idx)+i)%len(c.servers)]
+	}
+	return replicas, nil
+}
+
+// liveReplicas returns the live servers storing key, primary first.
+func (c *Client) liveReplicas(key string) ([]*server, error) {
+	replicas, err := c.replicas(key)
+	if err != nil {
+		return nil, err
+	}
+	live := replicas[:0]
+	for _, s := range replicas {
+		if s.alive() {
+			live = append(live, s)
+		}
+	}
+	if len(live) == 0 {
+		return nil, errAllServersDead()
+	}
+	return live, nil
+}
+
+// writeQuorum returns the number of replicas a write must succeed on, out of
+// the live replicas of a key. An explicit WriteQuorum counts all the replicas
+// of the key, dead or alive, so writes fail rather than succeed on fewer
+// replicas than asked for when too many are dead.
+func (c *Client) writeQuorum(live int) int {
+	quorum := c.config.WriteQuorum
+	if quorum <= 0 {
+		return live
+	}
+	if n := c.numReplicas(); quorum > n {
+		quorum = n
+	}
+	return quorum
+}
+
+// numReplicas returns the number of servers each key is stored on.
+func (c *Client) numReplicas() int {
+	if c.config.Replicas > len(c.servers) {
+		return len(c.servers)
+	}
+	return c.config.Replicas
+}
+
+func errNoWriteQuorum(live, quorum int) error {
+	return &Error{StatusNetworkError,
+		fmt.Sprintf("mc: write quorum of %d unreachable, %d replicas live", quorum, live), nil}
+}
+
+func (c *Client) performReplicated(m *msg) error {
+	replicas, err := c.liveReplicas(m.key)
+	if err != nil {
+		return err
+	}
+	if isWrite(m.Op) {
+		return c.writeReplicated(m, replicas)
+	}
+	if m.Op == opGAT {
+		return c.gatReplicated(m, replicas)
+	}
+	return c.readReplicated(m, replicas)
+}
+
+// gatReplicated performs a GAT on all replicas and answers with the first one
+// that has the key, or else with the first answer from a server (e.g., a miss)
+// over a network error.
+func (c *Client) gatReplicated(m *msg, replicas []*server) error {
+	rms := make([]msg, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i := range replicas {
+		rms[i] = *m
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.performOn(replicas[i], &rms[i])
+		}(i)
+	}
+	wg.Wait()
+
+	result := 0
+	for i, err := range errs {
+		if err == nil {
+			result = i
+			break
+		}
+		if connBroken(errs[result]) && !connBroken(err) {
+			result = i
+		}
+	}
+	*m = rms[result]
+	return errs[result]
+}
+
+// readReplicated tries the replicas in order until one has the key.
+func (c *Client) readReplicated(m *msg, replicas []*server) error {
+	key := m.key
+	var misses []*server
+	var firstErr error
+	for _, s := range replicas {
+		rm := *m
+		_, err := c.performOn(s, &rm)
+		if err == nil {
+			*m = rm
+			if c.config.ReadRepair && c.config.ReadRepairExpiration > 0 && len(misses) > 0 {
+				go c.readRepair(misses, key, m.val, m.flags)
+			}
+			return nil
+		}
+		if err == ErrNotFound {
+			misses = append(misses, s)
+		} else if !connBroken(err) {
+			// a real answer from the server, e.g. a CAS mismatch
+			*m = rm
+			return err
+		}
+		if firstErr == nil || firstErr != ErrNotFound && err == ErrNotFound {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// readRepair adds a value read from a replica to the replicas that missed it.
+func (c *Client) readRepair(misses []*server, key, val string, flags uint32) {
+	for _, s := range misses {
+		m := &msg{
+			header: header{
+				Op: opAdd,
+			},
+			iextras: setExtras{flags, c.config.ReadRepairExpiration},
+			key:     key,
+			val:     val,
+		}
+		c.performOn(s, m)
+	}
+}
+
+// writeReplicated writes m to all replicas, and succeeds if the write quorum
+// is reached.
+func (c *Client) writeReplicated(m *msg, replicas []*server) error {
+	quorum := c.writeQuorum(len(replicas))
+	if len(replicas) < quorum {
+		return errNoWriteQuorum(len(replicas), quorum)
+	}
+	rms := make([]msg, len(replicas))
+	errs := make([]error, len(replicas))
+
+	first := 0
+	if m.CAS != 0 {
+		// only the primary can check the CAS, the others follow its lead
+		rms[0] = *m
+		_, errs[0] = c.performOn(replicas[0], &rms[0])
+		if errs[0] != nil {
+			*m = rms[0]
+			return errs[0]
+		}
+		first = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := first; i < len(replicas); i++ {
+		rms[i] = *m
+		if m.CAS != 0 {
+			rms[i].CAS = 0
+			if m.Op == opReplace {
+				rms[i].Op = opSet
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.performOn(replicas[i], &rms[i])
+		}(i)
+	}
+	wg.Wait()
+
+	done, result := 0, -1
+	for i, err := range errs {
+		// a delete is done whether the replica had the key or not
+		if err == nil || (m.Op == opDelete && err == ErrNotFound) {
+			done++
+			if result < 0 || (errs[result] != nil && err == nil) {
+				result = i
+			}
+		}
+	}
+	if done < quorum {
+		for i, err := range errs {
+			if err != nil {
+				*m = rms[i]
+				return err
+			}
+		}
+	}
+	*m = rms[result]
+	return errs[result]
+}
@@ -0,0 +1,197 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testInitFakeCluster starts n fake servers and a client using all of them.
+func testInitFakeCluster(t *testing.T, n int, config *Config) (*Client, []*fakeServer) {
+	var fss []*fakeServer
+	var addrs []string
+	for i := 0; i < n; i++ {
+		fs := newFakeServer(t)
+		fss = append(fss, fs)
+		addrs = append(addrs, fs.addr())
+	}
+	c := NewMCwithConfig(strings.Join(addrs, ","), "", "", config)
+	return c, fss
+}
+
+func closeFakeCluster(fss []*fakeServer) {
+	for _, fs := range fss {
+		fs.close()
+	}
+}
+
+// replicaIndexes returns the indexes of the servers storing key.
+func replicaIndexes(t *testing.T, c *Client, key string) []int {
+	idx, err := c.config.Hasher.getServerIndex(key)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	var idxs []int
+	for i := 0; i < c.config.Replicas; i++ {
+		idxs = append(idxs, (int(idx)+i)%len(c.servers))
+	}
+	return idxs
+}
+
+func hasKey(fs *fakeServer, key string) bool {
+	for _, k := range fs.keys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	replicas := replicaIndexes(t, c, "foo")
+	for i, fs := range fss {
+		stored := i == replicas[0] || i == replicas[1]
+		assertEqualf(t, stored, hasKey(fs, "foo"), "wrong replicas for key on server %d", i)
+	}
+
+	err = c.Del("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for i, fs := range fss {
+		assertTruef(t, !hasKey(fs, "foo"), "key should be deleted from server %d", i)
+	}
+}
+
+func TestReplicatedReadRepair(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.ReadRepair = true
+	config.ReadRepairExpiration = 60
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 7, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	primary := fss[replicaIndexes(t, c, "foo")[0]]
+	primary.del("foo")
+
+	val, flags, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", val, "get should fall back to the replica")
+	assertEqualf(t, uint32(7), flags, "wrong flags")
+	repaired := waitUntil(func() bool { return hasKey(primary, "foo") })
+	assertTruef(t, repaired, "primary should have been repaired")
+}
+
+// Test that values aren't repaired without an expiration
+func TestReplicatedReadRepairNoExpiration(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	config.ReadRepair = true
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	primary := fss[replicaIndexes(t, c, "foo")[0]]
+	primary.del("foo")
+
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	time.Sleep(50 * time.Millisecond)
+	assertEqualf(t, 0, primary.requests(opAdd), "primary shouldn't be repaired")
+}
+
+func TestReplicatedServerDown(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 3
+	config.WriteQuorum = 2
+	config.Retries = 1
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	fss[replicaIndexes(t, c, "foo")[0]].close()
+
+	// the write quorum is still reached
+	_, err = c.Set("foo", "baz", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	val, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "baz", val, "get should fall back to a replica")
+
+	// but not with a quorum of all replicas, even though all live ones are
+	// reachable
+	config.WriteQuorum = 3
+	_, err = c.Set("foo", "qux", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "write should fail: %v", err)
+	val, _, _, err = c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "baz", val, "nothing should be written without a quorum")
+	for _, s := range c.servers {
+		s.changeAlive(true, nil)
+	}
+	_, err = c.Set("foo", "qux", 0, 0, 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "write should fail: %v", err)
+}
+
+func TestReplicatedGAT(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	replicas := replicaIndexes(t, c, "foo")
+	fss[replicas[0]].del("foo")
+
+	val, _, _, err := c.GAT("foo", 100)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", val, "GAT should fall back to a replica")
+	_, err = c.Touch("foo", 100)
+	assertEqualf(t, ErrNotFound, err, "expected a miss on the primary: %v", err)
+	for _, i := range replicas {
+		assertEqualf(t, 1, fss[i].requests(opGAT), "GAT should reach server %d", i)
+		assertEqualf(t, 1, fss[i].requests(opTouch), "touch should reach server %d", i)
+	}
+
+	fss[replicas[1]].del("foo")
+	_, _, _, err = c.GAT("foo", 100)
+	assertEqualf(t, ErrNotFound, err, "expected a miss: %v", err)
+}
+
+func TestReplicatedCAS(t *testing.T) {
+	config := DefaultConfig()
+	config.Replicas = 2
+	c, fss := testInitFakeCluster(t, 2, config)
+	defer closeFakeCluster(fss)
+
+	// make the CAS values of the servers differ
+	replicas := replicaIndexes(t, c, "foo")
+	fss[replicas[1]].lock.Lock()
+	fss[replicas[1]].cas = 1000
+	fss[replicas[1]].lock.Unlock()
+
+	cas, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, getCas, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, cas, getCas, "get should return the primary's CAS")
+
+	_, err = c.Set("foo", "baz", 0, 0, cas+1)
+	assertEqualf(t, ErrKeyExists, err, "wrong CAS should be rejected")
+	_, err = c.Set("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// the replica follows the primary
+	fss[replicas[0]].del("foo")
+	val, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "baz", val, "replica should have the CAS write")
+}
@@ -0,0 +1,85 @@
+package mc
+
+// Policies deciding when a request that failed with a network error is retried.
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides whether, and after how long, a request to a server is
+// tried again after a network error. Policies are shared by all requests to a
+// server, so they must be safe for concurrent use.
+//
+// Requests that aren't idempotent (see idempotent) are never retried once they
+// may have reached the server, whatever the policy says.
+type RetryPolicy interface {
+	// Backoff is called after attempt number attempt (starting at 1) of a
+	// request failed with err, elapsed after the first attempt was started.
+	// It returns how long to wait before the next attempt, or false to give
+	// up and return err.
+	Backoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// fixedRetry is the policy used without Config.RetryPolicy.
+type fixedRetry struct {
+	attempts int
+	delay    time.Duration
+}
+
+func (p fixedRetry) Backoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	return p.delay, attempt < p.attempts
+}
+
+// exponentialBackoff doubles the delay between attempts, with jitter.
+type exponentialBackoff struct {
+	base     time.Duration
+	max      time.Duration
+	attempts int
+	budget   time.Duration
+}
+
+// NewExponentialBackoff returns a policy waiting base before the second attempt
+// and doubling the delay after that, up to max. Each delay is randomly picked
+// between half and all of that, so clients don't retry in lockstep. A request
+// is tried at most attempts times, and is given up on (without waiting) once
+// the next attempt would start more than budget after the first one. A zero
+// budget means no limit.
+func NewExponentialBackoff(base, max time.Duration, attempts int, budget time.Duration) RetryPolicy {
+	return &exponentialBackoff{base: base, max: max, attempts: attempts, budget: budget}
+}
+
+func (p *exponentialBackoff) Backoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if attempt >= p.attempts {
+		return 0, false
+	}
+	delay := p.base
+	for i := 1; i < attempt && delay < p.max; i++ {
+		delay *= 2
+	}
+	if delay > p.max {
+		delay = p.max
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	if p.budget > 0 && elapsed+delay > p.budget {
+		return 0, false
+	}
+	return delay, true
+}
+
+// idempotent says if m can safely be sent again after it may already have
+// been processed by the server. Retrying a delete, an add or a request with a
+// CAS wouldn't change the data but would return a misleading error (e.g.,
+// ErrNotFound for a delete that worked), so those count as not idempotent.
+func idempotent(m *msg) bool {
+	switch m.Op {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATQ, opGATK, opGATKQ,
+		opTouch, opNoop, opVersion, opStat, opFlush, opFlushQ:
+		return true
+	case opSet, opSetQ, opReplace, opReplaceQ:
+		return m.CAS == 0
+	}
+	return false
+}
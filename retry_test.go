@@ -0,0 +1,80 @@
+package mc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	p := NewExponentialBackoff(10*time.Millisecond, 40*time.Millisecond, 5, 0)
+	for attempt, max := range []time.Duration{10, 20, 40, 40} {
+		max *= time.Millisecond
+		delay, retry := p.Backoff(attempt+1, 0, nil)
+		assertTruef(t, retry, "attempt %d should be retried", attempt+1)
+		assertTruef(t, delay >= max/2 && delay <= max,
+			"delay after attempt %d out of range: %v", attempt+1, delay)
+	}
+	_, retry := p.Backoff(5, 0, nil)
+	assertTruef(t, !retry, "shouldn't retry after the last attempt")
+
+	p = NewExponentialBackoff(10*time.Millisecond, time.Second, 10, 100*time.Millisecond)
+	_, retry = p.Backoff(1, 50*time.Millisecond, nil)
+	assertTruef(t, retry, "should retry within the budget")
+	_, retry = p.Backoff(2, 95*time.Millisecond, nil)
+	assertTruef(t, !retry, "shouldn't retry past the budget")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.RetryPolicy = NewExponentialBackoff(time.Millisecond, 5*time.Millisecond, 4, 0)
+	c := newMockableMC("s1-4", "", "", config, newMockConn)
+	defer c.Quit()
+
+	val, _, _, err := c.Get("k1")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "k1,s1,4", val, "get should succeed on the 4th attempt")
+}
+
+// Test that non idempotent requests aren't retried once they may have been sent
+func TestNoRetryNonIdempotent(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 3
+	config.Failover = false // keep the only server in use
+	c := newMockableMC("s1-2", "", "", config, newMockConn)
+	defer c.Quit()
+
+	_, err := c.Append("k1", "val", 0)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "append shouldn't be retried: %v", err)
+	_, err = c.Set("k1", "val", 0, 0, 0)
+	assertEqualf(t, nil, err, "set should be retried: %v", err)
+	_, err = c.Set("k1", "val", 0, 0, 1)
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "set with CAS shouldn't be retried: %v", err)
+}
+
+// failOpenConn fails to connect a number of times before working.
+type failOpenConn struct {
+	mcConn
+	failures int
+}
+
+func (c *failOpenConn) open() error {
+	if c.failures > 0 {
+		c.failures--
+		return &Error{StatusNetworkError, "Mock connect error", nil}
+	}
+	return nil
+}
+
+// Test that non idempotent requests are retried if nothing was sent
+func TestRetryNotSent(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 3
+	c := newMockableMC("s1", "", "", config,
+		func(address, scheme, username, password string, config *Config) mcConn {
+			return &failOpenConn{newMockConn(address, scheme, username, password, config), 2}
+		})
+	defer c.Quit()
+
+	_, err := c.Append("k1", "val", 0)
+	assertEqualf(t, nil, err, "append should be retried: %v", err)
+}
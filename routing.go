@@ -0,0 +1,154 @@
+package mc
+
+// Routing keys to several independent server pools.
+
+import (
+	"strings"
+)
+
+// ServerPool describes one of the memcached clusters fronted by a routing
+// client, see NewRoutedMC.
+type ServerPool struct {
+	Name     string
+	Servers  string // server list, as for NewMC
+	Username string
+	Password string
+	// Config is the configuration of the pool, nil meaning DefaultConfig().
+	// The pool uses a copy of it, so pools may share a Config.
+	Config *Config
+	// Prefixes are the key prefixes routed to the pool.
+	Prefixes []string
+}
+
+// keyPool is a pool of a routing client.
+type keyPool struct {
+	name     string
+	prefixes []string
+	client   *Client
+}
+
+// NewRoutedMC creates a client fronting several independent pools of servers,
+// each with its own configuration. A key goes to the pool named by route, if
+// route is not nil and returns the name of a pool, and otherwise to the pool
+// with the longest prefix of the key among its Prefixes. Keys matching no
+// prefix go to the first pool.
+//
+// Requests for a key are handled as if made on that pool's own client, so its
+// configuration (hasher, pool size, timeouts, compression, ...) applies.
+// Operations on all servers (Flush, Stats, Version, ...) cover the servers of
+// all pools, keyed by address, each server using its pool's configuration; the
+// settings of the operation as a whole (OperationTimeout, Tracer) are those of
+// DefaultConfig. FlushByPool, StatsByPool and VersionByPool report results
+// keyed by pool first, made with each pool's own client.
+//
+// It fails if two pools have the same name.
+func NewRoutedMC(pools []ServerPool, route func(key string) string) (*Client, error) {
+	client := &Client{config: DefaultConfig(), route: route}
+	names := make(map[string]bool)
+	for _, p := range pools {
+		if names[p.Name] {
+			return nil, &Error{StatusInvalidArgs, "mc: duplicate pool name " + p.Name, nil}
+		}
+		names[p.Name] = true
+		config := DefaultConfig()
+		if p.Config != nil {
+			// the hasher holds the servers of the pool, so each pool gets its
+			// own, of the kind asked for
+			c := *p.Config
+			if c.Hasher != nil {
+				c.Hasher = c.Hasher.clone()
+			} else {
+				c.Hasher = NewModuloHasher()
+			}
+			config = &c
+		}
+		pc := NewMCwithConfig(p.Servers, p.Username, p.Password, config)
+		pc.OnServerStateChange(client.notifyStateChange)
+		pc.OnBreakerStateChange(client.notifyBreakerChange)
+		client.pools = append(client.pools, &keyPool{p.Name, p.Prefixes, pc})
+		client.servers = append(client.servers, pc.servers...)
+	}
+	return client, nil
+}
+
+// pick returns the client of the pool key is routed to, which is c itself if
+// c isn't a routing client.
+func (c *Client) pick(key string) *Client {
+	if len(c.pools) == 0 {
+		return c
+	}
+	if c.route != nil {
+		name := c.route(key)
+		for _, p := range c.pools {
+			if p.name == name {
+				return p.client
+			}
+		}
+	}
+	best, bestLen := c.pools[0], -1
+	for _, p := range c.pools {
+		for _, prefix := range p.prefixes {
+			if len(prefix) > bestLen && strings.HasPrefix(key, prefix) {
+				best, bestLen = p, len(prefix)
+			}
+		}
+	}
+	return best.client
+}
+
+// Pools returns the client of each pool of a routing client, keyed by pool
+// name. A client that isn't routing returns itself under the name "".
+func (c *Client) Pools() map[string]*Client {
+	if len(c.pools) == 0 {
+		return map[string]*Client{"": c}
+	}
+	pools := make(map[string]*Client, len(c.pools))
+	for _, p := range c.pools {
+		pools[p.name] = p.client
+	}
+	return pools
+}
+
+// FlushByPool flushes every pool (see Flush), returning the outcome keyed by
+// pool name.
+func (c *Client) FlushByPool(when uint32) map[string]error {
+	errs := make(map[string]error)
+	for name, pc := range c.Pools() {
+		errs[name] = pc.Flush(when)
+	}
+	return errs
+}
+
+// StatsByPool returns the statistics of every server (see Stats), keyed by
+// pool name and then server address. Pools whose statistics couldn't be
+// fetched are reported in the error map.
+func (c *Client) StatsByPool() (map[string]map[string]McStats, map[string]error) {
+	stats := make(map[string]map[string]McStats)
+	errs := make(map[string]error)
+	for name, pc := range c.Pools() {
+		s, err := pc.Stats()
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		stats[name] = s
+	}
+	return stats, errs
+}
+
+// VersionByPool returns the version of every server (see Version), keyed by
+// pool name and then server address. Pools whose versions couldn't all be
+// fetched are reported in the error map instead.
+func (c *Client) VersionByPool() (map[string]map[string]string, map[string]error) {
+	vers := make(map[string]map[string]string)
+	errs := make(map[string]error)
+	for name, pc := range c.Pools() {
+		v, err := pc.Version()
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		vers[name] = v
+	}
+	return vers, errs
+}
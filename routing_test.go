@@ -0,0 +1,134 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+)
+
+func testInitRouted(t *testing.T, route func(key string) string) (*Client, *fakeServer, *fakeServer) {
+	sessions, renders := newFakeServer(t), newFakeServer(t)
+	config := DefaultConfig()
+	c, err := NewRoutedMC([]ServerPool{
+		{Name: "sessions", Servers: sessions.addr(), Config: config, Prefixes: []string{"session:"}},
+		{Name: "renders", Servers: renders.addr(), Config: config, Prefixes: []string{"render:"}},
+	}, route)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	pools := c.Pools()
+	assertTruef(t, pools["sessions"].config.Hasher != pools["renders"].config.Hasher,
+		"pools sharing a config should get their own hasher")
+	return c, sessions, renders
+}
+
+func TestRoutingDuplicatePool(t *testing.T) {
+	_, err := NewRoutedMC([]ServerPool{
+		{Name: "sessions", Servers: "localhost:11211"},
+		{Name: "sessions", Servers: "localhost:11212"},
+	}, nil)
+	assertTruef(t, err != nil, "duplicate pool names should be rejected")
+}
+
+func TestRoutingByPrefix(t *testing.T) {
+	c, sessions, renders := testInitRouted(t, nil)
+	defer sessions.close()
+	defer renders.close()
+
+	for _, key := range []string{"session:1", "render:1", "other"} {
+		_, err := c.Set(key, "val", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	}
+	assertTruef(t, hasKey(sessions, "session:1"), "session key should go to sessions")
+	assertTruef(t, hasKey(renders, "render:1"), "render key should go to renders")
+	assertTruef(t, hasKey(sessions, "other"), "other keys should go to the first pool")
+	assertEqualf(t, 2, len(sessions.keys()), "wrong keys in sessions")
+	assertEqualf(t, 1, len(renders.keys()), "wrong keys in renders")
+
+	val, _, _, err := c.Get("render:1")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "val", val, "wrong value")
+}
+
+func TestRoutingByFunction(t *testing.T) {
+	c, sessions, renders := testInitRouted(t, func(key string) string {
+		if strings.HasSuffix(key, ".png") {
+			return "renders"
+		}
+		return ""
+	})
+	defer sessions.close()
+	defer renders.close()
+
+	for _, key := range []string{"session:1.png", "session:2"} {
+		_, err := c.Set(key, "val", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	}
+	assertTruef(t, hasKey(renders, "session:1.png"), "route should win over prefixes")
+	assertTruef(t, hasKey(sessions, "session:2"), "prefixes should apply if route has no pool")
+}
+
+func TestRoutingBroadcast(t *testing.T) {
+	c, sessions, renders := testInitRouted(t, nil)
+	defer sessions.close()
+	defer renders.close()
+
+	vers, errs := c.VersionByPool()
+	assertEqualf(t, 0, len(errs), "unexpected errors: %v", errs)
+	assertEqualf(t, 2, len(vers), "wrong number of pools")
+	_, ok := vers["renders"][renders.addr()]
+	assertTruef(t, ok, "missing version of renders server: %v", vers)
+
+	stats, err := c.Stats()
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 2, len(stats), "stats should cover the servers of all pools")
+
+	_, err = c.Set("render:1", "val", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	flushed := c.FlushByPool(0)
+	assertEqualf(t, map[string]error{"sessions": nil, "renders": nil}, flushed, "wrong flush results")
+	_, _, _, err = c.Get("render:1")
+	assertEqualf(t, ErrNotFound, err, "flush should have cleared renders")
+
+	assertEqualf(t, 2, len(c.Servers()), "servers should cover all pools")
+}
+
+// firstHasher sends every key to the first server.
+type firstHasher struct {
+	servers int
+}
+
+func (h *firstHasher) update(servers []*server)                { h.servers = len(servers) }
+func (h *firstHasher) getServerIndex(key string) (uint, error) { return 0, nil }
+func (h *firstHasher) clone() hasher                           { return &firstHasher{} }
+
+func TestRoutingHasherKind(t *testing.T) {
+	config := DefaultConfig()
+	config.Hasher = &firstHasher{}
+	c, err := NewRoutedMC([]ServerPool{
+		{Name: "a", Servers: "localhost:11211", Config: config},
+		{Name: "b", Servers: "localhost:11212", Config: config},
+	}, nil)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	pools := c.Pools()
+	for name, pc := range pools {
+		_, ok := pc.config.Hasher.(*firstHasher)
+		assertTruef(t, ok, "pool %s should keep the kind of hasher configured", name)
+		assertTruef(t, pc.config.Hasher != config.Hasher, "pool %s should get a hasher of its own", name)
+	}
+	assertTruef(t, pools["a"].config.Hasher != pools["b"].config.Hasher, "pools should get their own hasher")
+}
+
+func TestRoutingVersionError(t *testing.T) {
+	sessions := newFakeServer(t)
+	defer sessions.close()
+	config := DefaultConfig()
+	config.Retries = 1
+	c, err := NewRoutedMC([]ServerPool{
+		{Name: "sessions", Servers: sessions.addr(), Config: config},
+		{Name: "down", Servers: sessions.addr() + ",127.0.0.1:1", Config: config},
+	}, nil)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	vers, errs := c.VersionByPool()
+	assertEqualf(t, 1, len(vers), "only complete pools should be reported: %v", vers)
+	assertTruef(t, vers["sessions"] != nil, "missing sessions versions: %v", vers)
+	assertTruef(t, errs["down"] != nil, "missing error of the down pool: %v", errs)
+}
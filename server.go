@@ -3,6 +3,7 @@ package mc
 // Handles all server connections to a particular memcached servers.
 
 import (
+	"context"
 	"net"
 	"net/url"
 	"strings"
@@ -12,14 +13,29 @@ import (
 
 // server represents a server and contains all connections to that server
 type server struct {
-	address string
-	scheme  string
-	config  *Config
-	// NOTE: organizing the pool as a chan makes the usage of the containing
-	// connections treadsafe
-	pool    chan mcConn
-	isAlive bool
-	lock    sync.Mutex
+	// hedge counters, first to be 64-bit aligned for atomic access
+	hedges    uint64
+	hedgeWins uint64
+
+	address  string
+	scheme   string
+	config   *Config
+	pool     *connPool
+	ejection EjectionPolicy
+	retry    RetryPolicy
+	breaker  *breaker
+	metrics  *serverMetrics
+	// latencies of hedged Gets
+	latencies latencies
+	// stateChanged is called after the server is ejected or revived
+	stateChanged func(addr string, alive bool, cause error)
+	// breakerChanged is called after the server's circuit breaker changed state
+	breakerChanged func(addr string, state BreakerState)
+
+	lock      sync.Mutex
+	isAlive   bool
+	lastErr   error
+	lastErrAt time.Time
 }
 
 const defaultPort = "11211"
@@ -54,104 +70,241 @@ func newServer(address, username, password string, config *Config, newMcConn con
 		address: addr,
 		scheme:  scheme,
 		config:  config,
-		pool:    make(chan mcConn, config.PoolSize),
 		isAlive: true,
 	}
-
-	for i := 0; i < config.PoolSize; i++ {
-		server.pool <- newMcConn(addr, scheme, username, password, config)
+	if config.EjectionPolicy != nil {
+		server.ejection = config.EjectionPolicy()
+	} else {
+		server.ejection = NewConsecutiveFailuresPolicy(1)
+	}
+	server.retry = config.RetryPolicy
+	if server.retry == nil {
+		server.retry = fixedRetry{config.Retries, config.RetryDelay}
+	}
+	server.metrics = newServerMetrics(config)
+	server.breaker = newBreaker(config, func(state BreakerState) {
+		if server.breakerChanged != nil {
+			server.breakerChanged(server.address, state)
+		}
+	})
+	server.pool = newConnPool(config, func() mcConn {
+		return newMcConn(addr, scheme, username, password, config)
+	})
+	if interval := server.pool.maintenanceInterval(); interval > 0 {
+		go server.pool.run(interval, server.alive)
 	}
 
 	return server
 }
 
-func (s *server) perform(m *msg) error {
-	var err error
-	for i := 0; ; {
-		timeout := time.After(s.config.ConnectionTimeout)
-		select {
-		case c := <-s.pool:
-			// NOTE: this serverConn is no longer available in the pool (equivalent to locking)
-			if c == nil {
-				return &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
-			}
+// getConn takes a connection from the pool for a request in ctx, capping the
+// pool wait and all I/O on the connection at deadline (if not zero).
+func (s *server) getConn(ctx context.Context, deadline time.Time) (*pooledConn, error) {
+	timeout := s.config.timeout(s.config.PoolTimeout)
+	if !deadline.IsZero() {
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+	}
+	c, err := s.pool.get(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.setDeadline(deadline)
+	return c, nil
+}
 
-			// backup request if a retry might be possible
-			if i+1 < s.config.Retries {
-				c.backup(m)
-			}
+// opDeadlineKey is the context key of the deadline of a client operation, see
+// Client.startOp.
+type opDeadlineKey struct{}
 
-			err = c.perform(m)
-			s.pool <- c
-			if err == nil {
-				return nil
-			}
-			// Return Memcached errors except network errors.
-			mErr := err.(*Error)
-			if mErr.Status != StatusNetworkError {
-				return err
-			}
+// opDeadline returns the deadline of request m started at start. It is the
+// deadline of the client operation m is part of, so that failovers, replicas
+// and hedges all stay within the operation's OperationTimeout, or start plus
+// OperationTimeout for requests made outside of an operation (e.g., probes).
+// The deadline of the context of m, if earlier, wins. It is zero without
+// either.
+func (s *server) opDeadline(m *msg, start time.Time) time.Time {
+	var deadline time.Time
+	if m.ctx != nil {
+		if d, ok := m.ctx.Value(opDeadlineKey{}).(time.Time); ok {
+			deadline = d
+		}
+	}
+	if deadline.IsZero() && s.config.OperationTimeout > 0 {
+		deadline = start.Add(s.config.OperationTimeout)
+	}
+	if m.ctx != nil {
+		if d, ok := m.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	return deadline
+}
 
-			// check if retry needed
-			i++
-			if i < s.config.Retries {
-				// restore request since m now contains the failed response
-				c.restore(m)
-				time.Sleep(s.config.RetryDelay)
-			} else {
-				return err
-			}
-		case <-timeout:
-			// do not retry
-			return &Error{StatusUnknownError,
-				"Timed out while waiting for connection from pool. " +
-					"Maybe increase your pool size?",
-				nil}
+// errContext returns the error of a request given up because its context is
+// done with err. It isn't a network error, as it says nothing about the server.
+func errContext(err error) error {
+	return &Error{StatusUnknownError, "Request given up: " + err.Error(), err}
+}
+
+// ctxErr returns errContext if the context of m is done, nil otherwise. The
+// context counts as done once its deadline passed, as the I/O deadline set
+// from it may expire just before the context's own timer fires.
+func (m *msg) ctxErr() error {
+	if m.ctx == nil {
+		return nil
+	}
+	err := m.ctx.Err()
+	if err == nil {
+		if d, ok := m.ctx.Deadline(); !ok || time.Now().Before(d) {
+			return nil
 		}
+		err = context.DeadlineExceeded
 	}
-	// return err
+	return errContext(err)
 }
 
-func (s *server) performStats(m *msg) (McStats, error) {
-	timeout := time.After(s.config.ConnectionTimeout)
-	select {
-	case c := <-s.pool:
-		// NOTE: this serverConn is no longer available in the pool (equivalent to locking)
-		if c == nil {
-			return nil, &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
+func (s *server) perform(m *msg) error {
+	start := time.Now()
+	deadline := s.opDeadline(m, start)
+	for attempt := 1; ; attempt++ {
+		if err := m.ctxErr(); err != nil {
+			return err
+		}
+		var sent bool
+		var err error
+		if len(s.config.Interceptors) > 0 || s.metrics != nil || s.config.Tracer != nil {
+			sent, err = s.interceptAttempt(m, attempt, deadline)
+		} else {
+			sent, err = s.attempt(m, deadline)
+		}
+		if err == nil {
+			return nil
+		}
+		// Return Memcached errors except network errors.
+		mErr := err.(*Error)
+		if mErr.Status != StatusNetworkError {
+			return err
+		}
+
+		if cerr := m.ctxErr(); cerr != nil {
+			// the I/O was interrupted, e.g., for the loser of a hedged Get
+			return cerr
 		}
 
-		stats, err := c.performStats(m)
-		s.pool <- c
-		return stats, err
+		// check if retry needed
+		if sent && !idempotent(m) {
+			return err
+		}
+		delay, retry := s.retry.Backoff(attempt, time.Since(start), err)
+		if !retry || (!deadline.IsZero() && time.Now().Add(delay).After(deadline)) {
+			return err
+		}
+		s.config.log(LogWarn, "mc: retrying request", "server", s.address,
+			"op", m.Op.String(), "attempt", attempt, "delay", delay, "error", err)
+		// m is left untouched by a failed request, so it can be resent
+		if m.ctx == nil {
+			time.Sleep(delay)
+			continue
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-m.ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// attempt makes a single attempt at performing m. It reports whether the
+// request may have been sent.
+func (s *server) attempt(m *msg, deadline time.Time) (sent bool, err error) {
+	// NOTE: the connection is no longer available in the pool until put back
+	// (equivalent to locking)
+	c, err := s.getConn(m.ctx, deadline)
+	if err != nil {
+		// not retried, as it isn't a network error
+		return false, err
+	}
 
-	case <-timeout:
-		// do not retry
-		return nil, &Error{StatusUnknownError,
-			"Timed out while waiting for connection from pool. " +
-				"Maybe increase your pool size?",
-			nil}
+	// nothing was sent yet if connecting fails
+	err = c.open()
+	if err == nil {
+		sent = true
+		err = c.perform(m)
 	}
+	s.pool.put(c)
+	if cerr := m.ctxErr(); err != nil && cerr != nil {
+		// the I/O was interrupted as ctx is done, the server isn't at fault
+		return sent, cerr
+	}
+	return sent, s.recordError(err)
 }
 
-func (s *server) quit(m *msg) {
-	for i := 0; i < s.config.PoolSize; i++ {
-		c := <-s.pool
-		if c == nil {
-			// Do not double quit
-			return
+func (s *server) performStats(m *msg) (stats McStats, err error) {
+	err = s.intercept(m.Op, m.key, 1, []*msg{m}, func() (int, error) {
+		if err := m.ctxErr(); err != nil {
+			return 0, err
 		}
-		c.quit(m)
-	}
-	close(s.pool)
+		c, err := s.getConn(m.ctx, s.opDeadline(m, time.Now()))
+		if err != nil {
+			return 0, err
+		}
+		stats, err = c.performStats(m)
+		s.pool.put(c)
+		if cerr := m.ctxErr(); err != nil && cerr != nil {
+			return 0, cerr
+		}
+		return 0, s.recordError(err)
+	})
+	return stats, err
+}
+
+func (s *server) performMulti(ms []*msg) error {
+	return s.intercept(opGetKQ, "", 1, ms, func() (int, error) {
+		c, err := s.getConn(ms[0].ctx, s.opDeadline(ms[0], time.Now()))
+		if err != nil {
+			return 0, err
+		}
+		err = c.performMulti(ms)
+		s.pool.put(c)
+		if cerr := ms[0].ctxErr(); err != nil && cerr != nil {
+			return responseLen(ms, err), cerr
+		}
+		return responseLen(ms, err), s.recordError(err)
+	})
 }
 
-func (s *server) changeAlive(alive bool) bool {
+func (s *server) quit(m *msg) {
+	s.pool.close(m)
+}
+
+func (s *server) alive() bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if s.isAlive != alive {
-		s.isAlive = alive
-		return true
+	return s.isAlive
+}
+
+// changeAlive marks the server alive or dead, cause being the error that got
+// it ejected. It reports whether the state changed.
+func (s *server) changeAlive(alive bool, cause error) bool {
+	s.lock.Lock()
+	if s.isAlive == alive {
+		s.lock.Unlock()
+		return false
+	}
+	s.isAlive = alive
+	s.lock.Unlock()
+
+	if alive {
+		s.ejection.Reset()
+		s.config.log(LogInfo, "mc: server revived", "server", s.address)
+	} else {
+		s.config.log(LogWarn, "mc: server ejected", "server", s.address, "cause", cause)
+	}
+	if s.stateChanged != nil {
+		s.stateChanged(s.address, alive, cause)
 	}
-	return false
+	return true
 }
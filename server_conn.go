@@ -3,36 +3,70 @@ package mc
 // Handles the connection with the memcached servers.
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 type mcConn interface {
 	perform(m *msg) error
 	performStats(m *msg) (McStats, error)
+	performMulti(ms []*msg) error
+	open() error
+	close()
 	quit(m *msg)
-	backup(m *msg)
-	restore(m *msg)
+	// setDeadline caps all I/O of the following requests at t, zero removes
+	// the cap.
+	setDeadline(t time.Time)
 }
 
 type connGen func(address, scheme, username, password string, config *Config) mcConn
 
 // serverConn is a connection to a memcache server.
 type serverConn struct {
-	address   string
-	scheme    string
-	username  string
-	password  string
-	config    *Config
-	conn      net.Conn
-	buf       *bytes.Buffer
-	opq       uint32
-	backupMsg msg
+	address  string
+	scheme   string
+	username string
+	password string
+	config   *Config
+	conn     net.Conn
+	rd       *bufio.Reader
+	wbuf     *[]byte // requests encoded but not yet sent
+	hbuf     [headerLen]byte
+	opq      uint32
+	deadline time.Time // caps the per I/O timeouts if not zero
+}
+
+// bufPool holds the buffers used to encode requests and to read response
+// bodies, so a request doesn't have to allocate buffers it throws away once
+// it's done.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// maxPooledBuf is the largest buffer returned to bufPool, so a few large values
+// don't pin a lot of memory.
+const maxPooledBuf = 64 * 1024
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) > maxPooledBuf {
+		return
+	}
+	*b = (*b)[:0]
+	bufPool.Put(b)
 }
 
 func newServerConn(address, scheme, username, password string, config *Config) mcConn {
@@ -42,50 +76,114 @@ func newServerConn(address, scheme, username, password string, config *Config) m
 		username: username,
 		password: password,
 		config:   config,
-		buf:      new(bytes.Buffer),
 	}
 	return serverConn
 }
 
 func (sc *serverConn) perform(m *msg) error {
 	// lazy connection
-	if sc.conn == nil {
-		err := sc.connect()
-		if err != nil {
-			return err
-		}
+	err := sc.open()
+	if err != nil {
+		return err
 	}
+	defer sc.cancelOn(m.ctx)()
 	return sc.sendRecv(m)
 }
 
 func (sc *serverConn) performStats(m *msg) (McStats, error) {
 	// lazy connection
-	if sc.conn == nil {
-		err := sc.connect()
-		if err != nil {
-			return nil, err
-		}
+	err := sc.open()
+	if err != nil {
+		return nil, err
 	}
+	defer sc.cancelOn(m.ctx)()
 	return sc.sendRecvStats(m)
 }
 
+func (sc *serverConn) performMulti(ms []*msg) error {
+	// lazy connection
+	err := sc.open()
+	if err != nil {
+		return err
+	}
+	defer sc.cancelOn(ms[0].ctx)()
+	return sc.sendRecvMulti(ms)
+}
+
 func (sc *serverConn) quit(m *msg) {
 	if sc.conn != nil {
 		sc.sendRecv(m)
+		sc.close()
+	}
+}
 
-		if sc.conn != nil {
-			sc.conn.Close()
-			sc.conn = nil
+// open connects to the server, unless already connected.
+func (sc *serverConn) open() error {
+	if sc.conn != nil {
+		return nil
+	}
+	return sc.connect()
+}
+
+// close closes the connection to the server (without sending a quit).
+func (sc *serverConn) close() {
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+		sc.rd = nil
+		sc.config.log(LogInfo, "mc: disconnected", "server", sc.address)
+	}
+}
+
+func (sc *serverConn) setDeadline(t time.Time) {
+	sc.deadline = t
+}
+
+// cancelOn interrupts the I/O on the connection once ctx is done, so a request
+// that is no longer wanted (e.g., the loser of a hedged Get) doesn't hold on to
+// the connection: it fails with a network error, which closes the connection.
+// The function returned must be called once the request is over.
+func (sc *serverConn) cancelOn(ctx context.Context) (stop func()) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
+	conn := sc.conn
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// fails pending I/O, later I/O sets its own deadlines
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
 		}
+	}()
+	return func() {
+		close(done)
+		<-exited
 	}
 }
 
+// deadlineAfter returns the deadline for I/O taking at most d, capped by the
+// deadline set with setDeadline.
+func (sc *serverConn) deadlineAfter(d time.Duration) time.Time {
+	t := time.Now().Add(d)
+	if !sc.deadline.IsZero() && sc.deadline.Before(t) {
+		return sc.deadline
+	}
+	return t
+}
+
 func (sc *serverConn) connect() error {
-	c, err := net.DialTimeout(sc.scheme, sc.address, sc.config.ConnectionTimeout)
+	dialer := net.Dialer{Deadline: sc.deadlineAfter(sc.config.timeout(sc.config.DialTimeout))}
+	c, err := dialer.Dial(sc.scheme, sc.address)
 	if err != nil {
+		sc.config.log(LogWarn, "mc: connect failed", "server", sc.address, "error", err)
 		return wrapError(StatusNetworkError, err)
 	}
 	sc.conn = c
+	sc.rd = bufio.NewReader(c)
 	if sc.scheme == "tcp" {
 		tcpConn, ok := c.(*net.TCPConn)
 		if !ok {
@@ -102,13 +200,15 @@ func (sc *serverConn) connect() error {
 		// Error, except if the server doesn't support authentication
 		mErr := err.(*Error)
 		if mErr.Status != StatusUnknownCommand {
-			if sc.conn != nil {
-				sc.conn.Close()
-				sc.conn = nil
-			}
+			sc.config.log(LogError, "mc: authentication failed",
+				"server", sc.address, "user", sc.username, "error", err)
+			sc.close()
 			return err
 		}
+	} else if len(sc.username) > 0 || len(sc.password) > 0 {
+		sc.config.log(LogDebug, "mc: authenticated", "server", sc.address, "user", sc.username)
 	}
+	sc.config.log(LogInfo, "mc: connected", "server", sc.address)
 	return nil
 }
 
@@ -193,44 +293,120 @@ func (sc *serverConn) sendRecvStats(m *msg) (stats McStats, err error) {
 		}
 		stats[m.key] = m.val
 	}
-	return
 }
 
-// send sends a request to the memcache server.
-func (sc *serverConn) send(m *msg) error {
-	m.Magic = magicSend
-	m.ExtraLen = sizeOfExtras(m.iextras)
-	m.KeyLen = uint16(len(m.key))
-	m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(len(m.val))
-	m.Opaque = sc.opq
-	sc.opq++
-
-	// Request
-	err := binary.Write(sc.buf, binary.BigEndian, m.header)
+// sendRecvMulti pipelines a batch of quiet get requests, terminated by a NOOP,
+// and receives their responses. Each message gets the response status stored in
+// its header, keys the server had no value for are marked StatusNotFound.
+func (sc *serverConn) sendRecvMulti(ms []*msg) error {
+	opqs := make(map[uint32]*msg, len(ms))
+	for _, m := range ms {
+		m.Op = opGetKQ
+		err := sc.encode(m)
+		if err != nil {
+			sc.discard()
+			return err
+		}
+		opqs[m.Opaque] = m
+	}
+	noop := &msg{header: header{Op: opNoop}}
+	err := sc.encode(noop)
+	if err == nil {
+		err = sc.flush()
+	}
 	if err != nil {
-		return wrapError(StatusNetworkError, err)
+		sc.discard()
+		sc.resetConn(err)
+		return err
 	}
 
-	for _, e := range m.iextras {
-		err = binary.Write(sc.buf, binary.BigEndian, e)
-		if err != nil {
-			return wrapError(StatusNetworkError, err)
+	// responses arrive in order, the NOOP response marks the end of the batch
+	for {
+		r := &msg{}
+		err = sc.recvMatching(r, func(h *header) bool {
+			if h.Op == opNoop {
+				return h.Opaque == noop.Opaque
+			}
+			_, ok := opqs[h.Opaque]
+			return h.Op == opGetKQ && ok
+		})
+		if err != nil && connBroken(err) {
+			sc.resetConn(err)
+			return err
+		}
+		if r.Op == opNoop {
+			break
 		}
+		if m, ok := opqs[r.Opaque]; ok {
+			m.header = r.header
+			m.flags = r.flags
+			m.val = r.val
+			delete(opqs, r.Opaque)
+		}
+	}
+	for _, m := range opqs {
+		m.ResvOrStatus = StatusNotFound
 	}
+	return nil
+}
 
-	_, err = io.WriteString(sc.buf, m.key)
+// send sends a request to the memcache server.
+func (sc *serverConn) send(m *msg) error {
+	err := sc.encode(m)
 	if err != nil {
-		return wrapError(StatusNetworkError, err)
+		sc.discard()
+		return err
 	}
+	return sc.flush()
+}
 
-	_, err = io.WriteString(sc.buf, m.val)
+// encode writes a request into the send buffer without sending it.
+func (sc *serverConn) encode(m *msg) error {
+	err := checkExtras(m.Op, m.iextras)
 	if err != nil {
-		return wrapError(StatusNetworkError, err)
+		return err
+	}
+	if sc.wbuf == nil {
+		sc.wbuf = getBuf()
+	}
+	b := *sc.wbuf
+	start := len(b)
+
+	// header is written last, once all lengths are known
+	b = append(b, make([]byte, headerLen)...)
+	if m.iextras != nil {
+		b = m.iextras.appendTo(b)
 	}
+	b = append(b, m.key...)
+	b = append(b, m.val...)
 
+	m.Magic = magicSend
+	m.ExtraLen = uint8(len(b) - start - headerLen - len(m.key) - len(m.val))
+	m.KeyLen = uint16(len(m.key))
+	m.BodyLen = uint32(len(b) - start - headerLen)
+	m.Opaque = sc.opq
+	sc.opq++
+	m.header.encode(b[start:])
+	if sc.config.tracing() {
+		sc.trace("mc: send", &m.header, m.key, len(m.val))
+	}
+
+	*sc.wbuf = b
+	return nil
+}
+
+// flush sends all buffered requests to the memcache server.
+func (sc *serverConn) flush() error {
+	if sc.wbuf == nil {
+		return nil
+	}
+	if sc.config.WireRecorder != nil {
+		sc.recordSent(*sc.wbuf)
+	}
 	// Make sure write does not block forever
-	sc.conn.SetWriteDeadline(time.Now().Add(sc.config.ConnectionTimeout))
-	_, err = sc.buf.WriteTo(sc.conn)
+	sc.conn.SetWriteDeadline(sc.deadlineAfter(sc.config.timeout(sc.config.WriteTimeout)))
+	_, err := sc.conn.Write(*sc.wbuf)
+	sc.discard()
 	if err != nil {
 		return wrapError(StatusNetworkError, err)
 	}
@@ -238,116 +414,110 @@ func (sc *serverConn) send(m *msg) error {
 	return nil
 }
 
+// discard drops all buffered requests.
+func (sc *serverConn) discard() {
+	if sc.wbuf != nil {
+		putBuf(sc.wbuf)
+		sc.wbuf = nil
+	}
+}
+
 // recv receives a memcached response. It takes a msg into which to store the
-// response.
+// response. m is only modified once a complete response has been read, so a
+// request that failed with a network error can be sent again as is.
 func (sc *serverConn) recv(m *msg) error {
+	op, opq := m.Op, m.Opaque
+	return sc.recvMatching(m, func(h *header) bool {
+		return h.Op == op && h.Opaque == opq
+	})
+}
+
+// recvMatching receives a memcached response, checking that it is well formed
+// and, using match, that it answers a request that was sent. Any mismatch
+// means we lost track of where we are in the stream of responses, so it is
+// reported as a protocol error, which resets the connection.
+func (sc *serverConn) recvMatching(m *msg, match func(h *header) bool) error {
 	// Make sure read does not block forever
-	sc.conn.SetReadDeadline(time.Now().Add(sc.config.ConnectionTimeout))
+	sc.conn.SetReadDeadline(sc.deadlineAfter(sc.config.timeout(sc.config.ReadTimeout)))
 
-	err := binary.Read(sc.conn, binary.BigEndian, &m.header)
+	_, err := io.ReadFull(sc.rd, sc.hbuf[:])
 	if err != nil {
 		return wrapError(StatusNetworkError, err)
 	}
+	var h header
+	h.decode(sc.hbuf[:])
 
-	bd := make([]byte, m.BodyLen)
-	_, err = io.ReadFull(sc.conn, bd)
-	if err != nil {
-		return wrapError(StatusNetworkError, err)
+	switch {
+	case h.Magic != magicRecv:
+		err = protocolError("bad magic 0x%02x", uint8(h.Magic))
+	case !match(&h):
+		err = protocolError("unexpected response (op 0x%02x, opaque %d)",
+			uint8(h.Op), h.Opaque)
+	case sc.config.MaxBodySize > 0 && int64(h.BodyLen) > int64(sc.config.MaxBodySize):
+		err = protocolError("body of %d bytes exceeds maximum of %d",
+			h.BodyLen, sc.config.MaxBodySize)
+	case int(h.ExtraLen)+int(h.KeyLen) > int(h.BodyLen):
+		err = protocolError("extras and key (%d bytes) exceed body (%d bytes)",
+			int(h.ExtraLen)+int(h.KeyLen), h.BodyLen)
+	case h.ResvOrStatus == StatusOK && h.ExtraLen > 0 && h.ExtraLen < 4:
+		err = protocolError("extras of %d bytes too short", h.ExtraLen)
 	}
-
-	buf := bytes.NewBuffer(bd)
-
-	if m.ResvOrStatus == 0 && m.ExtraLen > 0 {
-		for _, e := range m.oextras {
-			err := binary.Read(buf, binary.BigEndian, e)
-			if err != nil {
-				return wrapError(StatusNetworkError, err)
-			}
+	if err != nil {
+		if sc.config.WireRecorder != nil {
+			sc.record(wireHeader, sc.hbuf[:], nil)
 		}
+		return err
 	}
 
-	m.key = string(buf.Next(int(m.KeyLen)))
-	vlen := int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen)
-	m.val = string(buf.Next(int(vlen)))
-	return newError(m.ResvOrStatus)
-}
-
-// sizeOfExtras returns the size of the extras field for the memcache request.
-func sizeOfExtras(extras []interface{}) (l uint8) {
-	for _, e := range extras {
-		switch e.(type) {
-		default:
-			panic(fmt.Sprintf("mc: unknown extra type (%T)", e))
-		case uint8:
-			l += 8 / 8
-		case uint16:
-			l += 16 / 8
-		case uint32:
-			l += 32 / 8
-		case uint64:
-			l += 64 / 8
-		}
+	bp := getBuf()
+	defer putBuf(bp)
+	if cap(*bp) < int(h.BodyLen) {
+		*bp = make([]byte, h.BodyLen)
 	}
-	return
-}
-
-// resetConn destroy connection if a network error occurred. serverConn will
-// reconnect on next usage.
-func (sc *serverConn) resetConn(err error) {
-	if err.(*Error).Status == StatusNetworkError {
-		sc.conn.Close()
-		sc.conn = nil
+	bd := (*bp)[:h.BodyLen]
+	_, err = io.ReadFull(sc.rd, bd)
+	if err != nil {
+		return wrapError(StatusNetworkError, err)
+	}
+	if sc.config.WireRecorder != nil {
+		sc.record(wireReceived, sc.hbuf[:], bd)
 	}
-}
 
-func (sc *serverConn) backup(m *msg) {
-	backupMsg(m, &sc.backupMsg)
-}
+	var flags uint32
+	if h.ResvOrStatus == StatusOK && h.ExtraLen > 0 {
+		flags = binary.BigEndian.Uint32(bd)
+	}
 
-func backupMsg(m *msg, backupMsg *msg) {
-	backupMsg.key = m.key
-	backupMsg.val = m.val
-	backupMsg.header.Magic = m.header.Magic
-	backupMsg.header.Op = m.header.Op
-	backupMsg.header.KeyLen = m.header.KeyLen
-	backupMsg.header.ExtraLen = m.header.ExtraLen
-	backupMsg.header.DataType = m.header.DataType
-	backupMsg.header.ResvOrStatus = m.header.ResvOrStatus
-	backupMsg.header.BodyLen = m.header.BodyLen
-	backupMsg.header.Opaque = m.header.Opaque
-	backupMsg.header.CAS = m.header.CAS
-	backupMsg.iextras = nil // go way of clearing a slice, this is just fucked up
-	for _, v := range m.iextras {
-		backupMsg.iextras = append(backupMsg.iextras, v)
-	}
-	backupMsg.oextras = nil
-	for _, v := range m.oextras {
-		backupMsg.oextras = append(backupMsg.oextras, v)
+	klen := int(h.ExtraLen) + int(h.KeyLen)
+	if sc.config.tracing() {
+		sc.trace("mc: recv", &h, string(bd[h.ExtraLen:klen]), len(bd)-klen)
 	}
+	m.header = h
+	m.flags = flags
+	m.key = string(bd[h.ExtraLen:klen])
+	m.val = string(bd[klen:])
+	return newError(m.ResvOrStatus)
 }
 
-func (sc *serverConn) restore(m *msg) {
-	restoreMsg(m, &sc.backupMsg)
+// connBroken reports whether err leaves the connection in an unknown state,
+// i.e., a network or protocol error.
+func connBroken(err error) bool {
+	status := err.(*Error).Status
+	return status == StatusNetworkError || status == StatusProtocolError
 }
 
-func restoreMsg(m *msg, backupMsg *msg) {
-	m.key = backupMsg.key
-	m.val = backupMsg.val
-	m.header.Magic = backupMsg.header.Magic
-	m.header.Op = backupMsg.header.Op
-	m.header.KeyLen = backupMsg.header.KeyLen
-	m.header.ExtraLen = backupMsg.header.ExtraLen
-	m.header.DataType = backupMsg.header.DataType
-	m.header.ResvOrStatus = backupMsg.header.ResvOrStatus
-	m.header.BodyLen = backupMsg.header.BodyLen
-	m.header.Opaque = backupMsg.header.Opaque
-	m.header.CAS = backupMsg.header.CAS
-	m.iextras = nil // go way of clearing a slice, this is just fucked up
-	for _, v := range backupMsg.iextras {
-		m.iextras = append(m.iextras, v)
-	}
-	m.oextras = nil
-	for _, v := range backupMsg.oextras {
-		m.oextras = append(m.oextras, v)
+// resetConn destroy connection if a network or protocol error occurred.
+// serverConn will reconnect on next usage.
+func (sc *serverConn) resetConn(err error) {
+	if !connBroken(err) {
+		return
+	}
+	if err.(*Error).Status == StatusProtocolError {
+		sc.config.log(LogError, "mc: protocol error, resetting connection",
+			"server", sc.address, "error", err)
+	} else {
+		sc.config.log(LogWarn, "mc: network error, resetting connection",
+			"server", sc.address, "error", err)
 	}
+	sc.close()
 }
@@ -0,0 +1,224 @@
+package mc
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Responses that don't match their request are protocol errors and the
+// connection is reset, so the next request works again.
+func TestResponseValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite func(resp []byte) []byte
+	}{
+		{"magic", func(resp []byte) []byte {
+			resp[0] = byte(magicSend)
+			return resp
+		}},
+		{"op", func(resp []byte) []byte {
+			resp[1] = byte(opDelete)
+			return resp
+		}},
+		{"opaque", func(resp []byte) []byte {
+			binary.BigEndian.PutUint32(resp[12:16], binary.BigEndian.Uint32(resp[12:16])+1)
+			return resp
+		}},
+		{"body size", func(resp []byte) []byte {
+			binary.BigEndian.PutUint32(resp[8:12], 0xffffffff)
+			return resp
+		}},
+		{"key length", func(resp []byte) []byte {
+			binary.BigEndian.PutUint16(resp[2:4], 0xff)
+			return resp
+		}},
+	}
+
+	for _, tc := range tests {
+		c, fs := testInitFake(t, DefaultConfig())
+		_, err := c.Set("foo", "bar", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "%s: unexpected error: %v", tc.name, err)
+
+		rewrite := tc.rewrite
+		fs.setRewrite(func(r *fakeReq, resp []byte) []byte {
+			if r.op == opGet {
+				return rewrite(resp)
+			}
+			return resp
+		})
+		_, _, _, err = c.Get("foo")
+		assertTruef(t, err != nil, "%s: expected an error", tc.name)
+		assertEqualf(t, StatusProtocolError, err.(*Error).Status,
+			"%s: expected a protocol error: %v", tc.name, err)
+
+		fs.setRewrite(nil)
+		v, _, _, err := c.Get("foo")
+		assertEqualf(t, mcNil, err, "%s: unexpected error after reset: %v", tc.name, err)
+		assertEqualf(t, "bar", v, "%s: wrong value: %s", tc.name, v)
+		fs.close()
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBodySize = 10
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+
+	_, err := c.Set("foo", "0123456789", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("foo")
+	assertEqualf(t, StatusProtocolError, err.(*Error).Status,
+		"expected a protocol error: %v", err)
+}
+
+// A reply to another request in a multi-get batch is detected.
+func TestMultiGetDesync(t *testing.T) {
+	c, fs := testInitFake(t, DefaultConfig())
+	defer fs.close()
+
+	_, err := c.Set("a", "1", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	fs.setRewrite(func(r *fakeReq, resp []byte) []byte {
+		if r.op == opGetKQ {
+			binary.BigEndian.PutUint32(resp[12:16], 0xdead)
+		}
+		return resp
+	})
+	_, err = c.getMulti(context.Background(), []string{"a", "b"})
+	assertEqualf(t, StatusProtocolError, err.(*Error).Status,
+		"expected a protocol error: %v", err)
+}
+
+// Reads time out after ReadTimeout rather than ConnectionTimeout.
+func TestReadTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.ConnectionTimeout = 5 * time.Second
+	config.ReadTimeout = 50 * time.Millisecond
+	config.Retries = 1
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+	fs.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opGet {
+			return 200 * time.Millisecond
+		}
+		return 0
+	})
+
+	start := time.Now()
+	_, _, _, err := c.Get("foo")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a timeout: %v", err)
+	assertTruef(t, time.Since(start) < 150*time.Millisecond,
+		"get took too long: %v", time.Since(start))
+}
+
+// OperationTimeout caps a request including all of its retries.
+func TestOperationTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.ReadTimeout = 100 * time.Millisecond
+	config.Retries = 10
+	config.RetryDelay = 10 * time.Millisecond
+	config.OperationTimeout = 250 * time.Millisecond
+	c, fs := testInitFake(t, config)
+	defer fs.close()
+	fs.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opGet {
+			return time.Second
+		}
+		return 0
+	})
+
+	start := time.Now()
+	_, _, _, err := c.Get("foo")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a timeout: %v", err)
+	assertTruef(t, time.Since(start) < 400*time.Millisecond,
+		"get took too long: %v", time.Since(start))
+}
+
+// OperationTimeout caps an operation including its failovers to other servers.
+func TestOperationTimeoutFailover(t *testing.T) {
+	config := DefaultConfig()
+	config.ReadTimeout = 200 * time.Millisecond
+	config.Retries = 1
+	config.MaxEjectedFraction = 1
+	config.OperationTimeout = 250 * time.Millisecond
+	c, fss := testInitFakeCluster(t, 3, config)
+	defer closeFakeCluster(fss)
+	for _, fs := range fss {
+		fs.setDelay(func(r *fakeReq) time.Duration {
+			if r.op == opGet {
+				return time.Second
+			}
+			return 0
+		})
+	}
+
+	start := time.Now()
+	_, _, _, err := c.Get("foo")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a timeout: %v", err)
+	assertTruef(t, time.Since(start) < 400*time.Millisecond,
+		"get took too long: %v", time.Since(start))
+}
+
+// An operation gives up once its context is done, without counting against
+// the server.
+func TestContextCancel(t *testing.T) {
+	config := DefaultConfig()
+	config.BreakerFailures = 1
+	config.BreakerOpenTime = time.Minute
+	c, fss := testInitFakeCluster(t, 2, config)
+	defer closeFakeCluster(fss)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err := c.GetContext(ctx, "foo")
+	assertEqualf(t, StatusUnknownError, err.(*Error).Status, "expected a cancellation: %v", err)
+	assertEqualf(t, context.Canceled, err.(*Error).WrappedError, "wrong wrapped error: %v", err)
+	for _, fs := range fss {
+		assertEqualf(t, 0, fs.requests(opGet), "request shouldn't have been sent")
+	}
+
+	for _, fs := range fss {
+		fs.setDelay(func(r *fakeReq) time.Duration {
+			if r.op == opSet {
+				return time.Second
+			}
+			return 0
+		})
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.SetContext(ctx, "foo", "bar", 0, 0, 0)
+	assertEqualf(t, StatusUnknownError, err.(*Error).Status, "expected a timeout: %v", err)
+	assertEqualf(t, context.DeadlineExceeded, err.(*Error).WrappedError, "wrong wrapped error: %v", err)
+	assertTruef(t, time.Since(start) < 500*time.Millisecond, "set took too long: %v", time.Since(start))
+
+	for _, s := range c.servers {
+		assertTruef(t, s.alive(), "server %s was ejected", s.address)
+		assertEqualf(t, BreakerClosed, s.breaker.current(), "breaker of %s opened", s.address)
+	}
+}
+
+// A Stats in flight is interrupted once its context is done.
+func TestContextCancelStats(t *testing.T) {
+	c, fs := testInitFake(t, DefaultConfig())
+	defer fs.close()
+	fs.setDelay(func(r *fakeReq) time.Duration {
+		if r.op == opStat {
+			return time.Second
+		}
+		return 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.StatsWithKeyContext(ctx, "")
+	assertEqualf(t, StatusUnknownError, err.(*Error).Status, "expected a timeout: %v", err)
+	assertEqualf(t, context.DeadlineExceeded, err.(*Error).WrappedError, "wrong wrapped error: %v", err)
+	assertTruef(t, time.Since(start) < 500*time.Millisecond, "stats took too long: %v", time.Since(start))
+	assertTruef(t, c.servers[0].alive(), "server shouldn't be ejected")
+}
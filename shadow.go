@@ -0,0 +1,158 @@
+package mc
+
+// Mirroring a sample of the traffic to a candidate cluster.
+
+import (
+	"sync"
+	"time"
+)
+
+// Shadowing:
+// A shadowed client (see NewShadowedMC) serves all requests from its primary
+// client and mirrors a sample of them to a candidate client in the background.
+// The sample is picked by key, so all requests for a sampled key, writes
+// included, are mirrored and the candidate holds realistic data for them.
+// Mirrored writes don't carry the primary's CAS, which means nothing to the
+// candidate.
+//
+// The candidate's answers are compared with the primary's and only counted in
+// ShadowStats, they never reach the caller. At most shadowMaxInFlight mirrored
+// requests run at a time, more are dropped (and counted) so a slow candidate
+// can't pile up goroutines.
+
+// shadowMaxInFlight is the number of mirrored requests that may be in flight.
+const shadowMaxInFlight = 64
+
+// ShadowStats compares the answers of the candidate of a shadowed client with
+// those of its primary.
+type ShadowStats struct {
+	Mirrored         uint64        // requests mirrored to the candidate
+	Dropped          uint64        // sampled requests dropped, too many in flight
+	StatusMatches    uint64        // requests answered with the same status
+	StatusMismatches uint64        // requests answered with different statuses
+	CandidateMisses  uint64        // reads only the primary had the key for
+	CandidateOnly    uint64        // reads only the candidate had the key for
+	ValueMismatches  uint64        // reads both hit, with different values
+	PrimaryLatency   time.Duration // total latency of the primary, mirrored requests only
+	CandidateLatency time.Duration // total latency of the candidate
+}
+
+// shadow is the state of a shadowed client.
+type shadow struct {
+	primary, candidate *Client
+	sample             keySampler // requests for sampled keys are mirrored
+	slots              chan struct{}
+
+	lock  sync.Mutex
+	stats ShadowStats
+}
+
+// NewShadowedMC creates a client serving requests from primary and mirroring
+// the requests for a fraction sample (between 0 and 1) of the keys to
+// candidate, comparing their answers (see ShadowStats). Operations on all
+// servers (Flush, Stats, ...) only cover the primary's servers.
+func NewShadowedMC(primary, candidate *Client, sample float64) *Client {
+	sh := &shadow{
+		primary:   primary,
+		candidate: candidate,
+		sample:    newKeySampler("shadow:", sample),
+		slots:     make(chan struct{}, shadowMaxInFlight),
+	}
+	client := &Client{
+		config:  primary.config,
+		metrics: newClientMetrics(primary.config),
+		servers: primary.servers,
+		shadow:  sh,
+	}
+	primary.OnServerStateChange(client.notifyStateChange)
+	primary.OnBreakerStateChange(client.notifyBreakerChange)
+	return client
+}
+
+// ShadowStats returns the comparison of a shadowed client's candidate with its
+// primary, zero for any other client.
+func (c *Client) ShadowStats() ShadowStats {
+	if c.shadow == nil {
+		return ShadowStats{}
+	}
+	c.shadow.lock.Lock()
+	defer c.shadow.lock.Unlock()
+	return c.shadow.stats
+}
+
+func (sh *shadow) perform(m *msg) error {
+	key := m.key
+	if m.chunkOf != "" {
+		// the chunks of a value are sampled along with its manifest
+		key = m.chunkOf
+	}
+	if !sh.sample.sampled(key) {
+		return sh.primary.perform(m)
+	}
+	mirror := *m
+	if m.CAS != 0 {
+		// the primary's CAS means nothing to the candidate
+		mirror.CAS = 0
+	}
+	// the mirrored request outlives the operation
+	mirror.ctx = nil
+	start := time.Now()
+	err := sh.primary.perform(m)
+	latency := time.Since(start)
+
+	select {
+	case sh.slots <- struct{}{}:
+		go sh.mirror(&mirror, m.val, err, latency)
+	default:
+		sh.lock.Lock()
+		sh.stats.Dropped++
+		sh.lock.Unlock()
+	}
+	return err
+}
+
+// statusOf returns the status of the outcome of a request.
+func statusOf(err error) uint16 {
+	if err == nil {
+		return StatusOK
+	}
+	if mErr, ok := err.(*Error); ok {
+		return mErr.Status
+	}
+	return StatusUnknownError
+}
+
+// mirror sends m to the candidate and compares its answer with the primary's.
+func (sh *shadow) mirror(m *msg, val string, err error, latency time.Duration) {
+	defer func() { <-sh.slots }()
+	start := time.Now()
+	cerr := sh.candidate.perform(m)
+	clatency := time.Since(start)
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	st := &sh.stats
+	st.Mirrored++
+	st.PrimaryLatency += latency
+	st.CandidateLatency += clatency
+	if statusOf(err) == statusOf(cerr) {
+		st.StatusMatches++
+	} else {
+		st.StatusMismatches++
+	}
+	if isWrite(m.Op) {
+		return
+	}
+	switch {
+	case err == nil && cerr == ErrNotFound:
+		st.CandidateMisses++
+	case err == ErrNotFound && cerr == nil:
+		st.CandidateOnly++
+	case err == nil && cerr == nil && val != m.val:
+		// chunk manifests differ even for the same value
+		_, manifest := decodeChunkManifest(val)
+		if !manifest {
+			st.ValueMismatches++
+		}
+	}
+}
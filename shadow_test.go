@@ -0,0 +1,110 @@
+package mc
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestShadowSample(t *testing.T) {
+	sh := NewShadowedMC(&Client{}, &Client{}, 0.25).shadow
+	n := 0
+	for i := 0; i < 10000; i++ {
+		if sh.sample.sampled("key" + strconv.Itoa(i)) {
+			n++
+		}
+	}
+	assertTruef(t, n > 2000 && n < 3000, "sampled %d keys out of 10000", n)
+	assertTruef(t, sh.sample.sampled("key1") == sh.sample.sampled("key1"), "sample should be stable")
+	// keys differing only in their last character are sampled independently
+	n = 0
+	for i := 0; i < 10; i++ {
+		if sh.sample.sampled("key" + strconv.Itoa(i)) {
+			n++
+		}
+	}
+	assertTruef(t, n > 0 && n < 10, "sampled %d keys out of 10", n)
+
+	assertTruef(t, !NewShadowedMC(&Client{}, &Client{}, 0).shadow.sample.sampled("key1"),
+		"nothing should be sampled")
+	assertTruef(t, NewShadowedMC(&Client{}, &Client{}, 1).shadow.sample.sampled("key1"),
+		"everything should be sampled")
+}
+
+func TestShadow(t *testing.T) {
+	primaryFs, candidateFs := newFakeServer(t), newFakeServer(t)
+	defer primaryFs.close()
+	defer candidateFs.close()
+	candidate := NewMCwithConfig(candidateFs.addr(), "", "", DefaultConfig())
+	c := NewShadowedMC(NewMCwithConfig(primaryFs.addr(), "", "", DefaultConfig()), candidate, 1)
+	mirrored := func(n uint64) bool {
+		return waitUntil(func() bool { return c.ShadowStats().Mirrored == n })
+	}
+
+	for _, key := range []string{"same", "differs", "evicted"} {
+		_, err := c.Set(key, "val", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	}
+	assertTruef(t, mirrored(3), "writes should be mirrored")
+	assertTruef(t, hasKey(candidateFs, "same"), "candidate should have the key")
+
+	_, err := candidate.Set("differs", "other", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	candidateFs.del("evicted")
+	for _, key := range []string{"same", "differs", "evicted"} {
+		val, _, _, err := c.Get(key)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, "val", val, "value should come from the primary")
+	}
+	assertTruef(t, mirrored(6), "reads should be mirrored")
+
+	st := c.ShadowStats()
+	assertEqualf(t, uint64(5), st.StatusMatches, "wrong status matches")
+	assertEqualf(t, uint64(1), st.StatusMismatches, "wrong status mismatches")
+	assertEqualf(t, uint64(1), st.CandidateMisses, "wrong candidate misses")
+	assertEqualf(t, uint64(1), st.ValueMismatches, "wrong value mismatches")
+	assertEqualf(t, uint64(0), st.Dropped, "nothing should be dropped")
+	assertTruef(t, st.PrimaryLatency > 0 && st.CandidateLatency > 0, "latencies should be measured")
+}
+
+// Test that mirrored writes keep their op, a Replace doesn't create the key.
+func TestShadowReplace(t *testing.T) {
+	primaryFs, candidateFs := newFakeServer(t), newFakeServer(t)
+	defer primaryFs.close()
+	defer candidateFs.close()
+	primary := NewMCwithConfig(primaryFs.addr(), "", "", DefaultConfig())
+	c := NewShadowedMC(primary, NewMCwithConfig(candidateFs.addr(), "", "", DefaultConfig()), 1)
+
+	cas, err := primary.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Replace("foo", "baz", 0, 0, cas)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, waitUntil(func() bool { return c.ShadowStats().Mirrored == 1 }), "replace should be mirrored")
+	assertTruef(t, !hasKey(candidateFs, "foo"), "mirrored replace shouldn't create the key")
+	assertEqualf(t, uint64(1), c.ShadowStats().StatusMismatches, "candidate should miss the key")
+}
+
+// Test that the chunks of a large value are mirrored along with its manifest.
+func TestShadowChunks(t *testing.T) {
+	primaryFs, candidateFs := newFakeServer(t), newFakeServer(t)
+	defer primaryFs.close()
+	defer candidateFs.close()
+	config := DefaultConfig()
+	config.ChunkSize = 4
+	c := NewShadowedMC(NewMCwithConfig(primaryFs.addr(), "", "", config),
+		NewMCwithConfig(candidateFs.addr(), "", "", config), 0.5)
+
+	sampled := 0
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		_, err := c.Set(key, "abcdefghijkl", 0, 0, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		if c.shadow.sample.sampled(key) {
+			sampled++
+		}
+	}
+	assertTruef(t, sampled > 0 && sampled < 20, "sampled %d keys out of 20", sampled)
+	// 3 chunks and a manifest per key
+	assertTruef(t, waitUntil(func() bool { return c.ShadowStats().Mirrored == uint64(4*sampled) }),
+		"chunks should be mirrored with their manifest: %+v", c.ShadowStats())
+	assertEqualf(t, 4*sampled, len(candidateFs.keys()), "wrong keys on the candidate")
+}
@@ -0,0 +1,95 @@
+package mc
+
+// Observing the state of the servers of a client.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ServerState is a snapshot of the state of one server of a client.
+type ServerState struct {
+	Address     string
+	Alive       bool
+	Pool        PoolStats
+	Breaker     BreakerState
+	LastError   error     // last network or protocol error, nil if none yet
+	LastErrorAt time.Time // when LastError happened
+	Hedges      uint64    // hedged Gets sent, see Config.HedgePercentile
+	HedgeWins   uint64    // hedged Gets answered before the original
+}
+
+// OnServerStateChange registers fn to be called whenever a server is ejected
+// (alive is false, and cause is the error that got it ejected) or revived
+// (alive is true and cause is nil). Callbacks are run synchronously, in the
+// order they were registered, so they should return quickly.
+func (c *Client) OnServerStateChange(fn func(addr string, alive bool, cause error)) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.stateListeners = append(c.stateListeners, fn)
+}
+
+// OnBreakerStateChange registers fn to be called whenever the circuit breaker
+// of a server changes state (see Config.BreakerFailures). Callbacks are run
+// synchronously, in the order they were registered, so they should return
+// quickly.
+func (c *Client) OnBreakerStateChange(fn func(addr string, state BreakerState)) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.breakerListeners = append(c.breakerListeners, fn)
+}
+
+// Servers returns a snapshot of the state of all the servers of the client.
+func (c *Client) Servers() []ServerState {
+	states := make([]ServerState, len(c.servers))
+	for i, s := range c.servers {
+		states[i] = s.state()
+	}
+	return states
+}
+
+func (c *Client) notifyStateChange(addr string, alive bool, cause error) {
+	c.stateLock.Lock()
+	listeners := c.stateListeners
+	c.stateLock.Unlock()
+	for _, fn := range listeners {
+		fn(addr, alive, cause)
+	}
+}
+
+func (c *Client) notifyBreakerChange(addr string, state BreakerState) {
+	c.stateLock.Lock()
+	listeners := c.breakerListeners
+	c.stateLock.Unlock()
+	for _, fn := range listeners {
+		fn(addr, state)
+	}
+}
+
+// recordError remembers err as the server's last error if it is a network or
+// protocol error, and returns it.
+func (s *server) recordError(err error) error {
+	if err != nil && connBroken(err) {
+		s.lock.Lock()
+		s.lastErr = err
+		s.lastErrAt = time.Now()
+		s.lock.Unlock()
+	}
+	return err
+}
+
+func (s *server) state() ServerState {
+	s.lock.Lock()
+	state := ServerState{
+		Address:     s.address,
+		Alive:       s.isAlive,
+		LastError:   s.lastErr,
+		LastErrorAt: s.lastErrAt,
+	}
+	s.lock.Unlock()
+	state.Pool = s.pool.poolStats()
+	state.Breaker = s.breaker.current()
+	state.Hedges = atomic.LoadUint64(&s.hedges)
+	state.HedgeWins = atomic.LoadUint64(&s.hedgeWins)
+	return state
+}
@@ -0,0 +1,57 @@
+package mc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type stateEvent struct {
+	addr  string
+	alive bool
+	cause error
+}
+
+func TestServerStateChange(t *testing.T) {
+	config := DefaultConfig()
+	config.ProbeInterval = 10 * time.Millisecond
+	config.DownRetryDelay = 20 * time.Millisecond
+	config.ProbeSuccesses = 1
+	c := newMockableMC("s1-3,s2-1", "", "", config, newMockConn)
+	defer c.Quit()
+
+	var lock sync.Mutex
+	var events []stateEvent
+	c.OnServerStateChange(func(addr string, alive bool, cause error) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, stateEvent{addr, alive, cause})
+	})
+
+	_, _, _, err := c.Get("k2") // this key hashes to s1
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	states := c.Servers()
+	assertEqualf(t, 2, len(states), "wrong number of servers")
+	assertEqualf(t, "s1-3:11211", states[0].Address, "wrong address")
+	assertTruef(t, !states[0].Alive, "s1 should be dead")
+	assertTruef(t, states[0].LastError != nil, "s1 should have a last error")
+	assertTruef(t, !states[0].LastErrorAt.IsZero(), "s1 should have a last error time")
+	assertEqualf(t, 1, states[0].Pool.Open, "s1 should have a connection open")
+	assertTruef(t, states[1].Alive, "s2 should be alive")
+	assertEqualf(t, nil, states[1].LastError, "s2 shouldn't have an error")
+
+	revived := waitUntil(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(events) == 2
+	})
+	assertTruef(t, revived, "s1 should have been revived")
+	lock.Lock()
+	defer lock.Unlock()
+	assertEqualf(t, "s1-3:11211", events[0].addr, "wrong address on ejection")
+	assertTruef(t, !events[0].alive, "first event should be the ejection")
+	assertTruef(t, events[0].cause != nil, "ejection should have a cause")
+	assertEqualf(t, stateEvent{"s1-3:11211", true, nil}, events[1], "wrong revival event")
+	assertTruef(t, c.Servers()[0].Alive, "s1 should be alive again")
+}
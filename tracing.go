@@ -0,0 +1,82 @@
+package mc
+
+// Tracing of client operations, see Config.Tracer.
+
+import (
+	"context"
+)
+
+// Tracer creates the spans tracing client operations, see Config.Tracer. It is
+// typically an adapter to a tracing library, which keeps the current span (and
+// with it the trace context propagated between services, e.g., W3C
+// traceparent) in ctx.
+//
+// Every operation (Get, Set, Flush, ...) gets a span named "memcache.<op>",
+// e.g., "memcache.get", with a child span "memcache.request" for each attempt
+// at a request to a server. Retries and the requests to each server of
+// multi-key operations thus get spans of their own.
+type Tracer interface {
+	// Start starts a span named name, a child of the span in ctx if any, and
+	// returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. Operation spans get the attributes
+// "memcache.op", "memcache.key_hash" (an FNV-1a hash of the key, keys are
+// never recorded) and, for gets, "memcache.hit". Request spans get
+// "memcache.op", "memcache.server", "memcache.attempt", "memcache.keys",
+// "memcache.bytes_out", "memcache.bytes_in" and "memcache.status".
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// End ends the span, err being the outcome of the operation or request
+	// (nil on success).
+	End(err error)
+}
+
+// startSpan starts the span of an operation op on key, if tracing is enabled.
+// The span is nil otherwise.
+func (c *Client) startSpan(ctx context.Context, op opCode, key string) (context.Context, Span) {
+	if c.config.Tracer == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	name := op.String()
+	ctx, span := c.config.Tracer.Start(ctx, "memcache."+name)
+	span.SetAttribute("memcache.op", name)
+	if key != "" {
+		span.SetAttribute("memcache.key_hash", fnv32a(key))
+	}
+	return ctx, span
+}
+
+// endSpan ends the span of an operation op, if any, with the outcome err.
+func endSpan(span Span, op opCode, err error) {
+	if span == nil {
+		return
+	}
+	if isGet(op) && (err == nil || err == ErrNotFound) {
+		span.SetAttribute("memcache.hit", err == nil)
+	}
+	span.End(err)
+}
+
+// traceRequest runs next, the interceptors of an attempt, in a request span if
+// tracing is enabled.
+func (s *server) traceRequest(ctx context.Context, info *OpInfo, keys int, next func() error) error {
+	if s.config.Tracer == nil || ctx == nil {
+		return next()
+	}
+	_, span := s.config.Tracer.Start(ctx, "memcache.request")
+	span.SetAttribute("memcache.op", info.Op)
+	span.SetAttribute("memcache.server", info.Server)
+	span.SetAttribute("memcache.attempt", info.Attempt)
+	span.SetAttribute("memcache.keys", keys)
+	span.SetAttribute("memcache.bytes_out", info.BytesOut)
+	err := next()
+	span.SetAttribute("memcache.bytes_in", info.BytesIn)
+	span.SetAttribute("memcache.status", statusOf(err))
+	span.End(err)
+	return err
+}
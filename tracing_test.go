@@ -0,0 +1,151 @@
+package mc
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// testTracer records spans, keeping the current span in the context.
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  bool
+	err    error
+}
+
+type spanKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{tracer: t, name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.ended = true
+	s.err = err
+}
+
+// children returns the spans started from parent.
+func (t *testTracer) children(parent *testSpan) []*testSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var spans []*testSpan
+	for _, s := range t.spans {
+		if s.parent == parent {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	tracer := &testTracer{}
+	config := DefaultConfig()
+	config.Tracer = tracer
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	ctx, root := tracer.Start(context.Background(), "handler")
+	_, err := c.SetContext(ctx, "foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.GetContext(ctx, "foo")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.GetContext(ctx, "missing")
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+
+	ops := tracer.children(root.(*testSpan))
+	assertEqualf(t, 3, len(ops), "wrong number of operation spans")
+	set, hit, miss := ops[0], ops[1], ops[2]
+	assertEqualf(t, "memcache.set", set.name, "wrong span name")
+	assertEqualf(t, "set", set.attrs["memcache.op"], "wrong op")
+	assertEqualf(t, fnv32a("foo"), set.attrs["memcache.key_hash"], "wrong key hash")
+	assertTruef(t, set.ended && set.err == nil, "set span should have ended without error")
+	assertEqualf(t, nil, set.attrs["memcache.hit"], "sets have no hit attribute")
+	assertEqualf(t, true, hit.attrs["memcache.hit"], "get should be a hit")
+	assertEqualf(t, false, miss.attrs["memcache.hit"], "get should be a miss")
+	assertEqualf(t, ErrNotFound, miss.err, "wrong span error")
+
+	reqs := tracer.children(hit)
+	assertEqualf(t, 1, len(reqs), "wrong number of request spans")
+	req := reqs[0]
+	assertEqualf(t, "memcache.request", req.name, "wrong span name")
+	assertEqualf(t, fs.addr(), req.attrs["memcache.server"], "wrong server")
+	assertEqualf(t, 1, req.attrs["memcache.attempt"], "wrong attempt")
+	assertEqualf(t, headerLen+3, req.attrs["memcache.bytes_out"], "wrong bytes out")
+	assertEqualf(t, headerLen+4+3, req.attrs["memcache.bytes_in"], "wrong bytes in")
+	assertEqualf(t, StatusOK, req.attrs["memcache.status"], "wrong status")
+
+	// operations without a context are traced as roots
+	err = c.Flush(0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	roots := tracer.children(nil)
+	flush := roots[len(roots)-1]
+	assertEqualf(t, "memcache.flush", flush.name, "wrong span name")
+	assertEqualf(t, 1, len(tracer.children(flush)), "wrong number of request spans")
+}
+
+// Test that retries and the servers of a multi-get get spans of their own
+func TestTracingRequests(t *testing.T) {
+	tracer := &testTracer{}
+	config := DefaultConfig()
+	config.Tracer = tracer
+	config.Retries = 3
+	config.RetryDelay = 0
+	c := newMockableMC("s1-3", "", "", config, newMockConn)
+	defer c.Quit()
+
+	_, _, _, err := c.GetContext(context.Background(), "k1")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	get := tracer.children(nil)[0]
+	reqs := tracer.children(get)
+	assertEqualf(t, 3, len(reqs), "each attempt should have a span")
+	for i, req := range reqs {
+		assertEqualf(t, i+1, req.attrs["memcache.attempt"], "wrong attempt")
+	}
+	assertEqualf(t, StatusNetworkError, reqs[0].attrs["memcache.status"], "wrong status")
+	assertEqualf(t, StatusOK, reqs[2].attrs["memcache.status"], "wrong status")
+
+	fs1, fs2 := newFakeServer(t), newFakeServer(t)
+	defer fs1.close()
+	defer fs2.close()
+	tracer = &testTracer{}
+	config = DefaultConfig()
+	config.Tracer = tracer
+	c = NewMCwithConfig(fs1.addr()+","+fs2.addr(), "", "", config)
+	defer c.Quit()
+
+	ctx, root := tracer.Start(context.Background(), "handler")
+	keys := append(keysOnServer(t, c, 0, 2), keysOnServer(t, c, 1, 3)...)
+	_, err = c.getMulti(ctx, keys)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	reqs = tracer.children(root.(*testSpan))
+	assertEqualf(t, 2, len(reqs), "each server should have a span")
+	servers := map[interface{}]interface{}{}
+	for _, req := range reqs {
+		servers[req.attrs["memcache.server"]] = req.attrs["memcache.keys"]
+	}
+	assertEqualf(t, map[interface{}]interface{}{fs1.addr(): 2, fs2.addr(): 3}, servers, "wrong request spans")
+}
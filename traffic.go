@@ -0,0 +1,176 @@
+package mc
+
+// Recording of client operations, to be replayed for load testing, see
+// Config.TrafficRecorder and Client.Replay.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TrafficRecorder records the key operations (gets, sets, deletes, ...) of
+// clients, see Config.TrafficRecorder. Only the size of values is recorded,
+// not the values themselves.
+//
+// Records are written as:
+//
+//	[0..7]   time of the operation since the recorder was created, in
+//	         nanoseconds (uint64)
+//	[8..11]  latency of the operation, in microseconds (uint32)
+//	[12..15] size of the value (uint32)
+//	[16..]   the request as sent to a server without its value: its 24 byte
+//	         header, in which BodyLen only covers the extras and the key and
+//	         the status field holds the status of the response, followed by
+//	         the extras and the key
+//
+// All integers are big-endian, as in the binary protocol.
+type TrafficRecorder struct {
+	start  time.Time
+	sample keySampler // operations on sampled keys are recorded
+	secret []byte     // keys are hashed with, if not nil
+
+	lock sync.Mutex
+	w    *bufio.Writer
+	err  error
+}
+
+// NewTrafficRecorder creates a recorder writing to w. sample is the fraction
+// of keys whose operations are recorded (e.g., 0.01 for 1%), keys being
+// sampled rather than operations so that the operations on a recorded key are
+// all there to be replayed. If secret isn't nil, keys are replaced by an
+// HMAC-SHA256 of them keyed with secret, so that keys can't be found out from
+// a recording by hashing guesses without the secret. Records are buffered,
+// see Flush.
+func NewTrafficRecorder(w io.Writer, sample float64, secret []byte) *TrafficRecorder {
+	return &TrafficRecorder{
+		start:  time.Now(),
+		sample: newKeySampler("record:", sample),
+		secret: secret,
+		w:      bufio.NewWriter(w),
+	}
+}
+
+// Flush writes the buffered records. It returns the first error met writing
+// records, if any.
+func (tr *TrafficRecorder) Flush() error {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if tr.err == nil {
+		tr.err = tr.w.Flush()
+	}
+	return tr.err
+}
+
+// hashKey returns the key recorded for key, which is a hash of it if keys are
+// hashed. Hashes are 32 characters long, well within memcached's key size
+// limit.
+func (tr *TrafficRecorder) hashKey(key string) string {
+	if tr.secret == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, tr.secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// observe records the operation op on key, started at start, with err as its
+// outcome.
+func (tr *TrafficRecorder) observe(op opCode, key string, valLen int, extras reqExtras, start time.Time, err *error) {
+	if !tr.sample.sampled(key) {
+		return
+	}
+	latency := time.Since(start)
+	key = tr.hashKey(key)
+
+	b := make([]byte, 16+headerLen, 16+headerLen+20+len(key))
+	binary.BigEndian.PutUint64(b[0:8], uint64(start.Sub(tr.start)))
+	binary.BigEndian.PutUint32(b[8:12], uint32(latency/time.Microsecond))
+	binary.BigEndian.PutUint32(b[12:16], uint32(valLen))
+	if extras != nil {
+		b = extras.appendTo(b)
+	}
+	b = append(b, key...)
+	h := header{
+		Magic:        magicSend,
+		Op:           op,
+		KeyLen:       uint16(len(key)),
+		ExtraLen:     uint8(len(b) - 16 - headerLen - len(key)),
+		ResvOrStatus: statusOf(*err),
+		BodyLen:      uint32(len(b) - 16 - headerLen),
+	}
+	h.encode(b[16:])
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if tr.err == nil {
+		_, tr.err = tr.w.Write(b)
+	}
+}
+
+// TrafficRecord is an operation recorded by a TrafficRecorder.
+type TrafficRecord struct {
+	Time     time.Duration // since the recording started
+	Latency  time.Duration
+	Op       string // see OpInfo.Op
+	Key      string
+	ValueLen int
+	Flags    uint32 // of sets, adds and replaces
+	Exp      uint32 // of sets, adds, replaces, touches, GATs, incrs and decrs
+	Delta    uint64 // of incrs and decrs
+	Initial  uint64 // of incrs and decrs
+	Status   uint16 // of the response, StatusNetworkError if there was none
+
+	op opCode
+}
+
+// ReadTrafficRecord reads the next record recorded by a TrafficRecorder from r.
+// It returns io.EOF once there are no more records.
+func ReadTrafficRecord(r io.Reader) (*TrafficRecord, error) {
+	var b [16 + headerLen]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var h header
+	h.decode(b[16:])
+	if h.Magic != magicSend || int(h.ExtraLen)+int(h.KeyLen) != int(h.BodyLen) {
+		return nil, fmt.Errorf("mc: bad traffic record (magic 0x%02x, body of %d bytes)",
+			uint8(h.Magic), h.BodyLen)
+	}
+	body := make([]byte, h.BodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rec := &TrafficRecord{
+		Time:     time.Duration(binary.BigEndian.Uint64(b[0:8])),
+		Latency:  time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Microsecond,
+		Op:       h.Op.String(),
+		Key:      string(body[h.ExtraLen:]),
+		ValueLen: int(binary.BigEndian.Uint32(b[12:16])),
+		Status:   h.ResvOrStatus,
+		op:       h.Op,
+	}
+	extras := body[:h.ExtraLen]
+	switch {
+	case len(extras) == 8:
+		rec.Flags = binary.BigEndian.Uint32(extras[0:4])
+		rec.Exp = binary.BigEndian.Uint32(extras[4:8])
+	case len(extras) == 20:
+		rec.Delta = binary.BigEndian.Uint64(extras[0:8])
+		rec.Initial = binary.BigEndian.Uint64(extras[8:16])
+		rec.Exp = binary.BigEndian.Uint32(extras[16:20])
+	case len(extras) == 4:
+		rec.Exp = binary.BigEndian.Uint32(extras[0:4])
+	}
+	return rec, nil
+}
@@ -0,0 +1,132 @@
+package mc
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readTraffic reads all the records in b.
+func readTraffic(t *testing.T, b []byte) []*TrafficRecord {
+	r := bytes.NewReader(b)
+	var recs []*TrafficRecord
+	for {
+		rec, err := ReadTrafficRecord(r)
+		if err == io.EOF {
+			return recs
+		}
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		recs = append(recs, rec)
+	}
+}
+
+func TestTrafficRecorder(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var buf bytes.Buffer
+	tr := NewTrafficRecorder(&buf, 1, nil)
+	config := DefaultConfig()
+	config.TrafficRecorder = tr
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	c.Set("foo", "bar", 7, 60, 0)
+	c.Get("foo")
+	c.Get("missing")
+	c.Incr("n", 2, 10, 30, 0)
+	c.Touch("foo", 90)
+	c.Del("foo")
+	c.Flush(0)
+	assertEqualf(t, nil, tr.Flush(), "unexpected error")
+
+	recs := readTraffic(t, buf.Bytes())
+	assertEqualf(t, 6, len(recs), "only key operations should be recorded")
+	set, hit, miss, incr, touch, del := recs[0], recs[1], recs[2], recs[3], recs[4], recs[5]
+	assertEqualf(t, "set", set.Op, "wrong op")
+	assertEqualf(t, "foo", set.Key, "wrong key")
+	assertEqualf(t, 3, set.ValueLen, "wrong value size")
+	assertEqualf(t, uint32(7), set.Flags, "wrong flags")
+	assertEqualf(t, uint32(60), set.Exp, "wrong expiration")
+	assertTruef(t, set.Latency > 0, "latency should be recorded")
+	assertEqualf(t, StatusOK, hit.Status, "wrong status")
+	assertEqualf(t, StatusNotFound, miss.Status, "wrong status")
+	assertTruef(t, miss.Time > hit.Time, "times should increase")
+	assertEqualf(t, uint64(2), incr.Delta, "wrong delta")
+	assertEqualf(t, uint64(10), incr.Initial, "wrong initial value")
+	assertEqualf(t, uint32(30), incr.Exp, "wrong expiration")
+	assertEqualf(t, uint32(90), touch.Exp, "wrong expiration")
+	assertEqualf(t, "delete", del.Op, "wrong op")
+}
+
+func TestTrafficRecorderSampleAndHash(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var buf bytes.Buffer
+	tr := NewTrafficRecorder(&buf, 0.25, []byte("secret"))
+	config := DefaultConfig()
+	config.TrafficRecorder = tr
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	for i := 0; i < 400; i++ {
+		key := "key" + strconv.Itoa(i)
+		c.Set(key, "val", 0, 0, 0)
+		c.Get(key)
+	}
+	tr.Flush()
+
+	recs := readTraffic(t, buf.Bytes())
+	assertTruef(t, len(recs) > 2*50 && len(recs) < 2*150, "sampled %d records out of 800", len(recs))
+	gets := make(map[string]bool)
+	for _, rec := range recs {
+		assertEqualf(t, 32, len(rec.Key), "keys should be hashed")
+		if rec.Op == "get" {
+			gets[rec.Key] = true
+		}
+	}
+	for _, rec := range recs {
+		if rec.Op == "set" {
+			assertTruef(t, gets[rec.Key], "all operations on a sampled key should be recorded")
+		}
+	}
+	assertEqualf(t, tr.hashKey("key1"), tr.hashKey("key1"), "hashes should be stable")
+	other := NewTrafficRecorder(&buf, 0.25, []byte("other secret"))
+	assertTruef(t, tr.hashKey("key1") != other.hashKey("key1"), "hashes should depend on the secret")
+}
+
+// Test that a recorder flushes records written by several clients at once
+func TestTrafficRecorderConcurrent(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var buf syncBuffer
+	tr := NewTrafficRecorder(&buf, 1, nil)
+	config := DefaultConfig()
+	config.TrafficRecorder = tr
+	config.PoolSize = 4
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 50; j++ {
+				c.Get(strconv.Itoa(i*100 + j))
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	tr.Flush()
+	assertEqualf(t, 200, len(readTraffic(t, buf.buf.Bytes())), "wrong number of records")
+}
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // start connection
@@ -127,3 +128,22 @@ func assertTruef(t *testing.T, res bool, format string, args ...interface{}) {
 		t.Fatalf(format, args...)
 	}
 }
+
+// start connection to a fake server
+func testInitFake(t *testing.T, config *Config) (*Client, *fakeServer) {
+	fs := newFakeServer(t)
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	return c, fs
+}
+
+// waitUntil polls cond until it holds or a couple of seconds have passed.
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
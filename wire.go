@@ -0,0 +1,194 @@
+package mc
+
+// Recording of the frames exchanged with servers, see Config.WireRecorder.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// kinds of wire records, see WireRecord
+const (
+	wireSent     = 'S'
+	wireReceived = 'R'
+	wireHeader   = 'H'
+)
+
+// maxWireBody is the largest frame body ReadWireRecord accepts, the default
+// Config.MaxBodySize, so a corrupt record can't have it allocate gigabytes.
+const maxWireBody = 64 * 1024 * 1024
+
+// wireLock serializes the records written by all connections, so they don't
+// interleave when connections share a writer.
+var wireLock sync.Mutex
+
+// record writes a record of kind with the frame made of hdr and body to the
+// wire recorder. Errors are ignored, recording mustn't break requests. The
+// values of SASL requests and responses, which hold credentials, are zeroed.
+func (sc *serverConn) record(kind byte, hdr, body []byte) {
+	b := make([]byte, 0, 11+len(sc.address)+len(hdr)+len(body))
+	b = append(b, kind)
+	var n [10]byte
+	binary.BigEndian.PutUint64(n[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(n[8:10], uint16(len(sc.address)))
+	b = append(b, n[:]...)
+	b = append(b, sc.address...)
+	b = append(b, hdr...)
+	b = append(b, body...)
+	maskAuth(b[len(b)-len(hdr)-len(body):])
+	wireLock.Lock()
+	sc.config.WireRecorder.Write(b)
+	wireLock.Unlock()
+}
+
+// maskAuth zeroes the value of frame if it's a SASL authentication request or
+// response. Its length is kept, so the frame stays consistent.
+func maskAuth(frame []byte) {
+	if len(frame) < headerLen {
+		return
+	}
+	if op := opCode(frame[1]); op != opAuthStart && op != opAuthStep {
+		return
+	}
+	n := headerLen + int(frame[4]) + int(binary.BigEndian.Uint16(frame[2:4]))
+	for i := n; i < len(frame); i++ {
+		frame[i] = 0
+	}
+}
+
+// recordSent records the frames in b, a buffer of encoded requests.
+func (sc *serverConn) recordSent(b []byte) {
+	for len(b) >= headerLen {
+		n := headerLen + int(binary.BigEndian.Uint32(b[8:12]))
+		sc.record(wireSent, b[:n], nil)
+		b = b[n:]
+	}
+}
+
+// WireRecord is a frame recorded by Config.WireRecorder.
+//
+// Records are written to Config.WireRecorder as:
+//
+//	[0]      kind: 'S' for a frame sent, 'R' for a frame received, 'H' for a
+//	         received header that was rejected (see below)
+//	[1..8]   time, in nanoseconds since the Unix epoch (int64)
+//	[9..10]  length of the server address (uint16)
+//	[11..n]  server address
+//	[n+1..]  frame: its 24 byte header followed by its body (extras, key and
+//	         value, BodyLen bytes in all), except for 'H' records that have
+//	         no body as it was never read
+//
+// The value of SASL authentication frames (sasl_auth and sasl_step) is
+// recorded as zeros, so credentials never make it to the recording.
+//
+// All integers are big-endian, as in the binary protocol. 'H' records are
+// written for responses with a bad magic, an unexpected op or opaque or
+// inconsistent lengths, which get the connection reset.
+type WireRecord struct {
+	Sent bool // sent to the server rather than received from it
+	// HeaderOnly is set for a response that was rejected once its header was
+	// read, Extras, Key and Value are then empty.
+	HeaderOnly bool
+	Time       time.Time
+	Server     string
+
+	Magic    uint8
+	Op       uint8
+	KeyLen   uint16
+	ExtraLen uint8
+	DataType uint8
+	Status   uint16 // the status of a response, reserved in a request
+	BodyLen  uint32
+	Opaque   uint32
+	CAS      uint64
+
+	Extras []byte
+	Key    []byte
+	Value  []byte
+}
+
+// ReadWireRecord reads the next record recorded by Config.WireRecorder from r.
+// It returns io.EOF once there are no more records, and an error for frames
+// with a body over 64 MiB.
+func ReadWireRecord(r io.Reader) (*WireRecord, error) {
+	var b [11]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	kind := b[0]
+	if kind != wireSent && kind != wireReceived && kind != wireHeader {
+		return nil, fmt.Errorf("mc: bad wire record kind 0x%02x", kind)
+	}
+	rec := &WireRecord{
+		Sent:       kind == wireSent,
+		HeaderOnly: kind == wireHeader,
+		Time:       time.Unix(0, int64(binary.BigEndian.Uint64(b[1:9]))),
+	}
+	addr := make([]byte, binary.BigEndian.Uint16(b[9:11]))
+	var hb [headerLen]byte
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rec.Server = string(addr)
+
+	var h header
+	h.decode(hb[:])
+	rec.Magic, rec.Op = uint8(h.Magic), uint8(h.Op)
+	rec.KeyLen, rec.ExtraLen, rec.DataType = h.KeyLen, h.ExtraLen, h.DataType
+	rec.Status, rec.BodyLen = h.ResvOrStatus, h.BodyLen
+	rec.Opaque, rec.CAS = h.Opaque, h.CAS
+	if rec.HeaderOnly {
+		return rec, nil
+	}
+	if h.BodyLen > maxWireBody {
+		return nil, fmt.Errorf("mc: wire record body of %d bytes exceeds %d bytes", h.BodyLen, maxWireBody)
+	}
+
+	body := make([]byte, h.BodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	elen, klen := int(h.ExtraLen), int(h.KeyLen)
+	if elen+klen > len(body) {
+		return nil, fmt.Errorf("mc: extras and key (%d bytes) exceed body (%d bytes)", elen+klen, len(body))
+	}
+	rec.Extras, rec.Key, rec.Value = body[:elen], body[elen:elen+klen], body[elen+klen:]
+	return rec, nil
+}
+
+// OpName returns the name of the op of the record, e.g., "get".
+func (rec *WireRecord) OpName() string {
+	return opCode(rec.Op).String()
+}
+
+// StatusName returns the name of the status of the record, e.g., "not_found",
+// which is only meaningful for responses.
+func (rec *WireRecord) StatusName() string {
+	if name, ok := statusNames[rec.Status]; ok {
+		return name
+	}
+	return fmt.Sprintf("status_0x%04x", rec.Status)
+}
+
+var statusNames = map[uint16]string{
+	StatusOK:             "ok",
+	StatusNotFound:       "not_found",
+	StatusKeyExists:      "key_exists",
+	StatusValueTooLarge:  "value_too_large",
+	StatusInvalidArgs:    "invalid_args",
+	StatusValueNotStored: "not_stored",
+	StatusNonNumeric:     "non_numeric",
+	StatusAuthRequired:   "auth_required",
+	StatusAuthContinue:   "auth_continue",
+	StatusUnknownCommand: "unknown_command",
+	StatusOutOfMemory:    "out_of_memory",
+}
@@ -0,0 +1,123 @@
+package mc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWireRecorder(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	var buf syncBuffer
+	config := DefaultConfig()
+	config.WireRecorder = &buf
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "bar", 1, 2, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get("missing")
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+
+	r := bytes.NewReader(buf.buf.Bytes())
+	var recs []*WireRecord
+	for {
+		rec, err := ReadWireRecord(r)
+		if err == io.EOF {
+			break
+		}
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		recs = append(recs, rec)
+	}
+	assertEqualf(t, 4, len(recs), "wrong number of records")
+
+	set := recs[0]
+	assertTruef(t, set.Sent, "set should be sent")
+	assertEqualf(t, "set", set.OpName(), "wrong op")
+	assertEqualf(t, fs.addr(), set.Server, "wrong server")
+	assertEqualf(t, []byte{0, 0, 0, 1, 0, 0, 0, 2}, set.Extras, "wrong extras")
+	assertEqualf(t, "foo", string(set.Key), "wrong key")
+	assertEqualf(t, "bar", string(set.Value), "wrong value")
+	assertTruef(t, !recs[1].Sent && recs[1].Opaque == set.Opaque, "set response should follow")
+	assertTruef(t, recs[1].CAS != 0, "set response should have a CAS")
+
+	miss := recs[3]
+	assertEqualf(t, "get", miss.OpName(), "wrong op")
+	assertEqualf(t, "not_found", miss.StatusName(), "wrong status")
+	assertTruef(t, !recs[2].Time.After(miss.Time), "records should be in order")
+}
+
+func TestWireRecorderRejectedHeader(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.setRewrite(func(r *fakeReq, resp []byte) []byte {
+		resp[0] = 0x42
+		return resp
+	})
+
+	var buf syncBuffer
+	config := DefaultConfig()
+	config.WireRecorder = &buf
+	config.Retries = 1
+	c := NewMCwithConfig(fs.addr(), "", "", config)
+	defer c.Quit()
+
+	_, _, _, err := c.Get("foo")
+	assertEqualf(t, StatusProtocolError, err.(*Error).Status, "expected protocol error: %v", err)
+
+	r := bytes.NewReader(buf.buf.Bytes())
+	_, err = ReadWireRecord(r)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	rec, err := ReadWireRecord(r)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertTruef(t, rec.HeaderOnly, "rejected response should be header only")
+	assertEqualf(t, uint8(0x42), rec.Magic, "wrong magic")
+	_, err = ReadWireRecord(r)
+	assertEqualf(t, io.EOF, err, "expected end of records")
+}
+
+func TestWireRecorderMasksAuth(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.user, fs.pass = "user", "secret-password"
+
+	var buf syncBuffer
+	config := DefaultConfig()
+	config.WireRecorder = &buf
+	c := NewMCwithConfig(fs.addr(), "user", "secret-password", config)
+	defer c.Quit()
+
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, !bytes.Contains(buf.buf.Bytes(), []byte("secret-password")), "password leaked")
+
+	r := bytes.NewReader(buf.buf.Bytes())
+	auth := 0
+	for {
+		rec, err := ReadWireRecord(r)
+		if err == io.EOF {
+			break
+		}
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		if rec.Sent && rec.OpName() == "sasl_auth" {
+			auth++
+			assertEqualf(t, "PLAIN", string(rec.Key), "wrong mechanism")
+			assertEqualf(t, make([]byte, len("\x00user\x00secret-password")), rec.Value, "value not masked")
+		}
+		if !rec.Sent && rec.OpName() == "set" {
+			assertEqualf(t, "ok", rec.StatusName(), "wrong status")
+		}
+	}
+	assertEqualf(t, 1, auth, "wrong number of sasl_auth records")
+}
+
+func TestReadWireRecordTooLarge(t *testing.T) {
+	b := []byte{wireReceived, 0, 0, 0, 0, 0, 0, 0, 1, 0, 3, 'a', ':', '1'}
+	h := header{Magic: magicRecv, Op: opGet, BodyLen: 0xffffffff}
+	var hb [headerLen]byte
+	h.encode(hb[:])
+	_, err := ReadWireRecord(bytes.NewReader(append(b, hb[:]...)))
+	assertTruef(t, err != nil && err != io.ErrUnexpectedEOF, "expected a body too large error: %v", err)
+}